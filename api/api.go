@@ -6,11 +6,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prattmic/restic-remote/auth0"
@@ -20,7 +20,7 @@ import (
 // API endpoints.
 const (
 	releaseEndpoint = "/api/v1/release"
-	eventEndpoint  = "/api/v1/event"
+	eventEndpoint   = "/api/v1/event"
 )
 
 type Config struct {
@@ -30,6 +30,23 @@ type Config struct {
 	// Root is the API root URL.
 	Root string `mapstructure:"root"`
 
+	// Timeout is the deadline for each request attempt. Defaults to 30s.
+	Timeout time.Duration
+
+	// MaxAttempts is the maximum number of attempts of each request, for
+	// network errors and 5xx responses. Defaults to 3.
+	MaxAttempts int `mapstructure:"max-attempts"`
+
+	// BreakerThreshold is the number of consecutive failed attempts after
+	// which no more requests are sent for the lifetime of the API.
+	// Defaults to 5. Negative values disable the breaker.
+	BreakerThreshold int `mapstructure:"breaker-threshold"`
+
+	// BatchDelay is how long the event helper methods queue events
+	// before sending them in a batch. If 0, events are sent immediately.
+	// With batching, API.Flush must be called before exit.
+	BatchDelay time.Duration `mapstructure:"batch-delay"`
+
 	// Hostname is the hostname to use for the event helper methods.
 	Hostname string
 }
@@ -46,11 +63,53 @@ type API struct {
 
 	// client connects to the API with authentication.
 	client *http.Client
+
+	// ctx is the context of the run. Once it is done, requests are no
+	// longer retried, but are still sent: they report how the run ended.
+	ctx context.Context
+
+	// timeout is the deadline for each request attempt.
+	timeout time.Duration
+
+	// maxAttempts is the maximum number of attempts of each request.
+	maxAttempts int
+
+	// breakerThreshold is the number of consecutive failures that open
+	// the circuit breaker, or <= 0 if it is disabled.
+	breakerThreshold int
+
+	// mu protects failures.
+	mu sync.Mutex
+
+	// failures is the number of consecutive failed attempts.
+	failures int
+
+	// batchDelay is how long events are queued before they are sent.
+	batchDelay time.Duration
+
+	// flushMu serializes Flush.
+	flushMu sync.Mutex
+
+	// queueMu protects the fields below.
+	queueMu sync.Mutex
+
+	// queued are the events waiting to be sent.
+	queued []BatchEvent
+
+	// flushTimer flushes the queue after batchDelay, or is nil if the
+	// queue is empty.
+	flushTimer *time.Timer
+
+	// flushErrs are the errors from background flushes, to be returned
+	// by the next Flush.
+	flushErrs []string
 }
 
 // New creates an API.
 //
-// ctx is used for authentication token refreshes.
+// ctx is used for authentication token refreshes. Requests are not canceled
+// with it, so events can still report a canceled run; each attempt is bounded
+// by the request timeout instead.
 func New(ctx context.Context, conf Config) (*API, error) {
 	if conf.Root == "" {
 		return nil, fmt.Errorf("API root must be provided")
@@ -66,11 +125,27 @@ func New(ctx context.Context, conf Config) (*API, error) {
 		return nil, err
 	}
 
-	return &API{
-		root:     *u,
-		hostname: conf.Hostname,
-		client:   client,
-	}, nil
+	a := &API{
+		root:             *u,
+		hostname:         conf.Hostname,
+		client:           client,
+		ctx:              ctx,
+		timeout:          conf.Timeout,
+		maxAttempts:      conf.MaxAttempts,
+		breakerThreshold: conf.BreakerThreshold,
+		batchDelay:       conf.BatchDelay,
+	}
+	if a.timeout <= 0 {
+		a.timeout = defaultTimeout
+	}
+	if a.maxAttempts <= 0 {
+		a.maxAttempts = defaultMaxAttempts
+	}
+	if a.breakerThreshold == 0 {
+		a.breakerThreshold = defaultBreakerThreshold
+	}
+
+	return a, nil
 }
 
 // url returns the full URL for the given endpoint.
@@ -82,36 +157,47 @@ func (a *API) url(e string) url.URL {
 	return u
 }
 
-// postJSON posts JSON object j to u.
-func (a *API) postJSON(u url.URL, j interface{}) error {
+// postJSON posts JSON object j to u, with idempotency key key if it is not
+// empty.
+func (a *API) postJSON(u url.URL, j interface{}, key string) error {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(j); err != nil {
 		return fmt.Errorf("error encoding %+v: %v", j, err)
 	}
 
-	r, err := a.client.Post(u.String(), "application/json", &buf)
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if key != "" {
+		header.Set(IdempotencyHeader, key)
+	}
+
+	code, b, err := a.do("POST", u, header, buf.Bytes())
 	if err != nil {
-		return fmt.Errorf("error making request: %v", err)
+		return err
 	}
-	defer r.Body.Close()
 
-	if r.StatusCode >= 200 && r.StatusCode < 300 {
+	if code >= 200 && code < 300 {
 		// Success.
 		return nil
 	}
 
-	// Read any error message sent.
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return fmt.Errorf("error reading body of failure response %+v: %v", r, err)
-	}
-
-	return fmt.Errorf("error response when writing JSON: %+v\n%s", r, string(b))
+	return fmt.Errorf("error response when writing JSON: %d %s\n%s", code, http.StatusText(code), string(b))
 }
 
 // WriteEvent sends an event to the server.
+//
+// Retries carry the same idempotency key, so the event is stored at most
+// once.
 func (a *API) WriteEvent(e *event.Event) error {
-	if err := a.postJSON(a.url(eventEndpoint), e); err != nil {
+	if e.Version == 0 {
+		e.Version = event.SchemaVersion
+	}
+
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return err
+	}
+	if err := a.postJSON(a.url(eventEndpoint), e, key); err != nil {
 		return fmt.Errorf("error writing event %+v: %v", e, err)
 	}
 	return nil
@@ -119,69 +205,210 @@ func (a *API) WriteEvent(e *event.Event) error {
 
 // ClientStarted writes a ClientStarted event.
 func (a *API) ClientStarted() error {
-	return a.WriteEvent(&event.Event{
+	return a.queue(&event.Event{
 		Type:      event.ClientStarted,
 		Timestamp: time.Now(),
 		Hostname:  a.hostname,
 	})
 }
 
+// queueDetails adds e with details d to the event queue.
+func (a *API) queueDetails(e *event.Event, d interface{}) error {
+	if err := e.SetDetails(d); err != nil {
+		return err
+	}
+	return a.queue(e)
+}
+
 // ClientVersion writes a ClientVersion event.
 func (a *API) ClientVersion(v string) error {
-	return a.WriteEvent(&event.Event{
+	return a.queueDetails(&event.Event{
 		Type:      event.ClientVersion,
 		Timestamp: time.Now(),
 		Hostname:  a.hostname,
 		Message:   v,
-	})
+	}, &event.VersionDetails{Version: v})
 }
 
 // ResticVersion writes a ResticVersion event.
 func (a *API) ResticVersion(v string) error {
-	return a.WriteEvent(&event.Event{
+	return a.queueDetails(&event.Event{
 		Type:      event.ResticVersion,
 		Timestamp: time.Now(),
 		Hostname:  a.hostname,
 		Message:   v,
-	})
+	}, &event.VersionDetails{Version: v})
 }
 
-// UpdateComplete writes an UpdateComplete event.
-func (a *API) UpdateComplete(r *Release) error {
-	return a.WriteEvent(&event.Event{
+// UpdateComplete writes an UpdateComplete event for an update from release
+// from to release to.
+func (a *API) UpdateComplete(from, to *Release) error {
+	return a.queueDetails(&event.Event{
 		Type:      event.UpdateComplete,
 		Timestamp: time.Now(),
 		Hostname:  a.hostname,
-		Message:   fmt.Sprintf("Updated to %+v", r),
+		Message:   fmt.Sprintf("Updated to %+v", to),
+	}, &event.UpdateDetails{
+		FromClient: from.ClientVersion,
+		FromRestic: from.ResticVersion,
+		ToClient:   to.ClientVersion,
+		ToRestic:   to.ResticVersion,
+	})
+}
+
+// RepositoryInitialized writes a RepositoryInitialized event for profile.
+func (a *API) RepositoryInitialized(profile, message string) error {
+	return a.queue(&event.Event{
+		Type:      event.RepositoryInitialized,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Message:   message,
 	})
 }
 
-// BackupStarted writes a BackupStarted event for dirs.
-func (a *API) BackupStarted(dirs []string) error {
-	return a.WriteEvent(&event.Event{
+// BackupStarted writes a BackupStarted event for dirs in profile.
+func (a *API) BackupStarted(profile string, dirs []string) error {
+	return a.queueDetails(&event.Event{
 		Type:      event.BackupStarted,
 		Timestamp: time.Now(),
 		Hostname:  a.hostname,
+		Profile:   profile,
 		Message:   strings.Join(dirs, "\n"),
-	})
+	}, &event.BackupStartedDetails{Paths: dirs})
 }
 
-// BackupSucceeded writes a BackupSucceeded event.
-func (a *API) BackupSucceeded(message string) error {
-	return a.WriteEvent(&event.Event{
+// BackupSucceeded writes a BackupSucceeded event for profile, which took the
+// given number of attempts, with summary s.
+func (a *API) BackupSucceeded(profile string, attempts int, s *event.BackupSummary, message string) error {
+	e := &event.Event{
 		Type:      event.BackupSucceeded,
 		Timestamp: time.Now(),
 		Hostname:  a.hostname,
+		Profile:   profile,
+		Attempts:  attempts,
 		Message:   message,
-	})
+	}
+	return a.queueDetails(e, s)
 }
 
-// BackupFailed writes a BackupFailed event.
-func (a *API) BackupFailed(message string) error {
-	return a.WriteEvent(&event.Event{
+// BackupFailed writes a BackupFailed event for profile, with failure cause,
+// after the given number of attempts.
+func (a *API) BackupFailed(profile, cause string, attempts int, message string) error {
+	return a.queue(&event.Event{
 		Type:      event.BackupFailed,
 		Timestamp: time.Now(),
 		Hostname:  a.hostname,
+		Profile:   profile,
+		Cause:     cause,
+		Attempts:  attempts,
+		Message:   message,
+	})
+}
+
+// BackupProgress writes a BackupProgress event for profile.
+func (a *API) BackupProgress(profile string, p event.Progress) error {
+	return a.queue(&event.Event{
+		Type:      event.BackupProgress,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Progress:  p,
+		Message:   fmt.Sprintf("%.1f%% done, ETA %v", p.PercentDone*100, p.ETA),
+	})
+}
+
+// BackupRetrying writes a BackupRetrying event for profile, after attempt
+// failed with cause.
+func (a *API) BackupRetrying(profile, cause string, attempt int, message string) error {
+	return a.queue(&event.Event{
+		Type:      event.BackupRetrying,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Cause:     cause,
+		Attempts:  attempt,
+		Message:   message,
+	})
+}
+
+// BackupSkipped writes a BackupSkipped event for profile, which is empty if
+// the entire run was skipped.
+func (a *API) BackupSkipped(profile, reason string) error {
+	return a.queue(&event.Event{
+		Type:      event.BackupSkipped,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Message:   reason,
+	})
+}
+
+// BackupTimedOut writes a BackupTimedOut event for profile, after the given
+// number of attempts.
+func (a *API) BackupTimedOut(profile string, attempts int, message string) error {
+	return a.queue(&event.Event{
+		Type:      event.BackupTimedOut,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Cause:     event.CauseTimeout,
+		Attempts:  attempts,
+		Message:   message,
+	})
+}
+
+// ForgetSucceeded writes a ForgetSucceeded event for profile.
+func (a *API) ForgetSucceeded(profile, message string) error {
+	return a.queue(&event.Event{
+		Type:      event.ForgetSucceeded,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Message:   message,
+	})
+}
+
+// ForgetFailed writes a ForgetFailed event for profile.
+func (a *API) ForgetFailed(profile, message string) error {
+	return a.queue(&event.Event{
+		Type:      event.ForgetFailed,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Message:   message,
+	})
+}
+
+// StaleLockRemoved writes a StaleLockRemoved event for profile.
+func (a *API) StaleLockRemoved(profile, message string) error {
+	return a.queue(&event.Event{
+		Type:      event.StaleLockRemoved,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Message:   message,
+	})
+}
+
+// HookSucceeded writes a HookSucceeded event for profile.
+func (a *API) HookSucceeded(profile, message string) error {
+	return a.queue(&event.Event{
+		Type:      event.HookSucceeded,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
+		Message:   message,
+	})
+}
+
+// HookFailed writes a HookFailed event for profile.
+func (a *API) HookFailed(profile, message string) error {
+	return a.queue(&event.Event{
+		Type:      event.HookFailed,
+		Timestamp: time.Now(),
+		Hostname:  a.hostname,
+		Profile:   profile,
 		Message:   message,
 	})
 }
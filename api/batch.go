@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prattmic/restic-remote/event"
+)
+
+// EventsEndpoint writes a batch of events. It requires the write:events
+// scope.
+const EventsEndpoint = "/api/v1/events"
+
+// MaxBatchEvents is the maximum number of events in a batch.
+const MaxBatchEvents = 500
+
+// BatchEvent is an event in a batch written to EventsEndpoint.
+type BatchEvent struct {
+	event.Event
+
+	// IdempotencyKey serves the same purpose as IdempotencyHeader for
+	// single events. It is optional.
+	IdempotencyKey string
+}
+
+// EventStatus is the result of writing one event of a batch. EventsEndpoint
+// responds with the status of each event, in the same order as the request.
+type EventStatus struct {
+	// Status is the HTTP status code for the event.
+	Status int
+
+	// Error describes the failure, if Status is not 2xx.
+	Error string
+}
+
+// batchSize is the number of events sent per batch by the API. It is lower
+// than MaxBatchEvents to keep requests small.
+const batchSize = 100
+
+// queue adds e to the event queue, to be sent by the next flush. Without
+// batching, e is sent immediately.
+func (a *API) queue(e *event.Event) error {
+	if a.batchDelay <= 0 {
+		return a.WriteEvent(e)
+	}
+
+	if e.Version == 0 {
+		e.Version = event.SchemaVersion
+	}
+
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return err
+	}
+
+	a.queueMu.Lock()
+	defer a.queueMu.Unlock()
+
+	a.queued = append(a.queued, BatchEvent{
+		Event:          *e,
+		IdempotencyKey: key,
+	})
+
+	switch {
+	case len(a.queued) >= batchSize:
+		go a.flushBackground()
+	case a.flushTimer == nil:
+		a.flushTimer = time.AfterFunc(a.batchDelay, a.flushBackground)
+	}
+	return nil
+}
+
+// flushBackground flushes the queue, saving any error for the next Flush.
+func (a *API) flushBackground() {
+	if err := a.Flush(); err != nil {
+		a.queueMu.Lock()
+		a.flushErrs = append(a.flushErrs, err.Error())
+		a.queueMu.Unlock()
+	}
+}
+
+// Flush sends all queued events. It returns any errors from sending events
+// since the last Flush, including background flushes.
+//
+// Flush must be called before exiting, or queued events are lost.
+func (a *API) Flush() error {
+	// Only one flush at a time, so that events are sent in order.
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.queueMu.Lock()
+	events := a.queued
+	a.queued = nil
+	if a.flushTimer != nil {
+		a.flushTimer.Stop()
+		a.flushTimer = nil
+	}
+	errs := a.flushErrs
+	a.flushErrs = nil
+	a.queueMu.Unlock()
+
+	for len(events) > 0 {
+		n := len(events)
+		if n > batchSize {
+			n = batchSize
+		}
+		if err := a.WriteEvents(events[:n]); err != nil {
+			errs = append(errs, err.Error())
+		}
+		events = events[n:]
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error sending events: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// WriteEvents sends a batch of events to the server.
+//
+// Servers without EventsEndpoint are sent each event individually.
+func (a *API) WriteEvents(events []BatchEvent) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(events); err != nil {
+		return fmt.Errorf("error encoding events: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	code, b, err := a.do("POST", a.url(EventsEndpoint), header, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("error writing %d events: %v", len(events), err)
+	}
+
+	if code == http.StatusNotFound {
+		return a.writeEventsIndividually(events)
+	}
+
+	if code < 200 || code >= 300 {
+		return fmt.Errorf("error response when writing %d events: %d %s\n%s", len(events), code, http.StatusText(code), string(b))
+	}
+
+	var statuses []EventStatus
+	if err := json.Unmarshal(b, &statuses); err != nil {
+		return fmt.Errorf("error decoding event statuses %q: %v", string(b), err)
+	}
+	if len(statuses) != len(events) {
+		return fmt.Errorf("got %d event statuses for %d events", len(statuses), len(events))
+	}
+
+	var errs []string
+	for i, s := range statuses {
+		if s.Status < 200 || s.Status >= 300 {
+			errs = append(errs, fmt.Sprintf("event %+v: %d %s", events[i].Event, s.Status, s.Error))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error writing %d of %d events: %s", len(errs), len(events), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// writeEventsIndividually sends each of events to the single event endpoint.
+func (a *API) writeEventsIndividually(events []BatchEvent) error {
+	var errs []string
+	for i := range events {
+		e := &events[i]
+		if err := a.postJSON(a.url(eventEndpoint), &e.Event, e.IdempotencyKey); err != nil {
+			errs = append(errs, fmt.Sprintf("event %+v: %v", e.Event, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error writing %d of %d events: %s", len(errs), len(events), strings.Join(errs, "; "))
+	}
+	return nil
+}
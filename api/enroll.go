@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/prattmic/restic-remote/auth0"
+)
+
+// Enrollment endpoints.
+const (
+	// EnrollEndpoint exchanges an enrollment token for host credentials.
+	// It is unauthenticated.
+	EnrollEndpoint = "/api/v1/enroll"
+
+	// TokenEndpoint issues access tokens for host credentials, using the
+	// same client credentials flow as Auth0.
+	TokenEndpoint = "/api/v1/token"
+
+	// EnrollmentsEndpoint creates enrollment tokens. It requires the
+	// write:enrollments scope.
+	EnrollmentsEndpoint = "/api/v1/enrollments"
+
+	// CredentialsEndpoint lists (read:credentials) and revokes
+	// (write:credentials) host credentials.
+	CredentialsEndpoint = "/api/v1/credentials"
+)
+
+// HostAudience is the audience of access tokens issued for host credentials.
+const HostAudience = "restic-remote-host"
+
+// EnrollRequest exchanges an enrollment token for host credentials.
+type EnrollRequest struct {
+	// Token is the one-time enrollment token.
+	Token string
+
+	// Hostname is the hostname the credentials are bound to.
+	Hostname string
+}
+
+// EnrollResponse contains the credentials issued to an enrolled host.
+type EnrollResponse struct {
+	// ClientID and ClientSecret are the host credentials.
+	ClientID     string
+	ClientSecret string
+
+	// TokenURL is the URL from which to obtain access tokens with the
+	// credentials.
+	TokenURL string
+}
+
+// CreateEnrollmentRequest requests a new enrollment token.
+type CreateEnrollmentRequest struct {
+	// Hostname optionally restricts the token to one hostname.
+	Hostname string
+
+	// TTL is how long the token is valid. The server picks a default if
+	// it is 0.
+	TTL int64
+}
+
+// CreateEnrollmentResponse contains a new enrollment token.
+type CreateEnrollmentResponse struct {
+	// Token is the one-time enrollment token.
+	Token string
+
+	// Expires is when the token expires, as a Unix time.
+	Expires int64
+}
+
+// Enroll exchanges the one-time enrollment token for credentials bound to
+// hostname, using the API at root.
+//
+// The returned config can be used for Config.ClientConfig.
+func Enroll(ctx context.Context, root, token, hostname string) (*auth0.ClientConfig, error) {
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, fmt.Errorf("malformed root URL %q: %v", root, err)
+	}
+	u.Path = path.Join(u.Path, EnrollEndpoint)
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(&EnrollRequest{Token: token, Hostname: hostname}); err != nil {
+		return nil, fmt.Errorf("error encoding request: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", u.String(), &buf)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	r, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error making enroll request: %v", err)
+	}
+	defer r.Body.Close()
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body of response %+v: %v", r, err)
+	}
+
+	if r.StatusCode < 200 || r.StatusCode >= 300 {
+		return nil, fmt.Errorf("error response when enrolling: %s\n%s", r.Status, string(b))
+	}
+
+	var res EnrollResponse
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("error decoding response %q: %v", string(b), err)
+	}
+
+	return &auth0.ClientConfig{
+		ClientID:     res.ClientID,
+		ClientSecret: res.ClientSecret,
+		Audience:     HostAudience,
+		TokenURL:     res.TokenURL,
+	}, nil
+}
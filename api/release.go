@@ -3,7 +3,7 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 )
 
 // Release describes combined restic/client executable release that can be
@@ -24,20 +24,13 @@ type Release struct {
 
 // GetRelease gets the current release.
 func (a *API) GetRelease() (*Release, error) {
-	u := a.url(releaseEndpoint)
-	r, err := a.client.Get(u.String())
+	code, b, err := a.do("GET", a.url(releaseEndpoint), nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error making release request: %v", err)
 	}
-	defer r.Body.Close()
 
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading body of response %+v: %v", r, err)
-	}
-
-	if r.StatusCode < 200 || r.StatusCode >= 300 {
-		return nil, fmt.Errorf("error response when getting release: %+v\n%s", r, string(b))
+	if code < 200 || code >= 300 {
+		return nil, fmt.Errorf("error response when getting release: %d %s\n%s", code, http.StatusText(code), string(b))
 	}
 
 	var release Release
@@ -50,7 +43,7 @@ func (a *API) GetRelease() (*Release, error) {
 
 // PostRelease posts new release.
 func (a *API) PostRelease(b *Release) error {
-	if err := a.postJSON(a.url(releaseEndpoint), b); err != nil {
+	if err := a.postJSON(a.url(releaseEndpoint), b, ""); err != nil {
 		return fmt.Errorf("error writing release %+v: %v", b, err)
 	}
 	return nil
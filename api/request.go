@@ -0,0 +1,163 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// IdempotencyHeader is the request header carrying the idempotency key of an
+// event. Retries of the same event carry the same key, so the server stores
+// it only once.
+const IdempotencyHeader = "Idempotency-Key"
+
+// Defaults for the request options in Config.
+const (
+	defaultTimeout          = 30 * time.Second
+	defaultMaxAttempts      = 3
+	defaultBreakerThreshold = 5
+)
+
+const (
+	// initialBackoff is the delay before the first retry of a request.
+	initialBackoff = time.Second
+
+	// maxBackoff is the maximum delay between retries of a request.
+	maxBackoff = 30 * time.Second
+)
+
+// unavailableError is returned for requests made after the circuit breaker
+// opened.
+type unavailableError struct {
+	// failures is the number of consecutive failures that opened the
+	// breaker.
+	failures int
+}
+
+// Error implements error.Error.
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("API unavailable after %d consecutive failures; not sending requests for the rest of this run", e.failures)
+}
+
+// newIdempotencyKey returns a new random idempotency key.
+func newIdempotencyKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("error generating idempotency key: %v", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// backoff returns the delay before retry n (starting at 1), with jitter.
+func backoff(n int) time.Duration {
+	d := float64(initialBackoff) * math.Pow(2, float64(n-1))
+	if d > float64(maxBackoff) {
+		d = float64(maxBackoff)
+	}
+	// Between d/2 and d, so retries from many clients don't align.
+	return time.Duration(d/2 + mrand.Float64()*d/2)
+}
+
+// retryable returns true if a response with status code should be retried.
+func retryable(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// breakerOpen returns an error if the circuit breaker is open.
+func (a *API) breakerOpen() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.breakerThreshold > 0 && a.failures >= a.breakerThreshold {
+		return &unavailableError{failures: a.failures}
+	}
+	return nil
+}
+
+// recordResult records the result of an attempt for the circuit breaker.
+// Only transient failures count, as they indicate an unhealthy server.
+func (a *API) recordResult(transient bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if transient {
+		a.failures++
+	} else {
+		a.failures = 0
+	}
+}
+
+// attempt makes a single request, with the per-request deadline. It returns
+// the response status code and body.
+//
+// The attempt is not canceled with a.ctx, so that the events reporting a
+// canceled run are still sent.
+func (a *API) attempt(method string, u url.URL, header http.Header, body []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("error creating request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	r, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer r.Body.Close()
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading body of response %s: %v", r.Status, err)
+	}
+
+	return r.StatusCode, b, nil
+}
+
+// do sends a request, retrying network errors and 5xx responses with
+// backoff. It returns the status code and body of the final response.
+//
+// Requests fail immediately once the circuit breaker is open. Once a.ctx is
+// done, requests are attempted only once, and their failures don't count
+// towards the breaker, as they may be caused by the cancellation.
+func (a *API) do(method string, u url.URL, header http.Header, body []byte) (int, []byte, error) {
+	var (
+		code int
+		b    []byte
+		err  error
+	)
+	for n := 1; ; n++ {
+		if err := a.breakerOpen(); err != nil {
+			return 0, nil, err
+		}
+
+		code, b, err = a.attempt(method, u, header, body)
+		transient := err != nil || retryable(code)
+		canceled := a.ctx.Err() != nil
+		if !transient || !canceled {
+			a.recordResult(transient)
+		}
+
+		if !transient || n >= a.maxAttempts || canceled {
+			break
+		}
+
+		select {
+		case <-a.ctx.Done():
+		case <-time.After(backoff(n)):
+		}
+	}
+	return code, b, err
+}
@@ -0,0 +1,216 @@
+package auth0
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	gauth0 "github.com/auth0-community/go-auth0"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// jwksAuthenticator authenticates access tokens signed by keys from a JWKS
+// URL, as issued by Auth0 and OIDC providers.
+type jwksAuthenticator struct {
+	// sp provides the signing keys.
+	sp *SecretProvider
+
+	// issuer is the expected token issuer.
+	issuer string
+
+	// audience are the accepted token audiences. Tokens must have at
+	// least one.
+	audience []string
+}
+
+// NewJWKSAuthenticator creates an Authenticator that validates access tokens
+// signed with any of Algorithms. It is used for both ProviderAuth0 and
+// ProviderOIDC.
+//
+// jwks is the URL of the JWKS keys for the API.
+// issuer is the API issuer.
+// audience are the unique identifiers of the APIs being validated.
+func NewJWKSAuthenticator(jwks, issuer string, audience []string) Authenticator {
+	return &jwksAuthenticator{
+		sp:       NewSecretProvider(jwks),
+		issuer:   issuer,
+		audience: audience,
+	}
+}
+
+// Authenticate implements Authenticator.Authenticate.
+func (a *jwksAuthenticator) Authenticate(r *http.Request) (Claims, error) {
+	t, err := gauth0.FromHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(t.Headers) < 1 {
+		return nil, gauth0.ErrInvalidTokenHeader
+	}
+
+	key, err := a.sp.verificationKey(requestContext(r), t.Headers[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var c jwt.Claims
+	claims := Claims{}
+	if err := t.Claims(key, &c, &claims); err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+
+	if err := c.Validate(jwt.Expected{Issuer: a.issuer, Time: time.Now()}); err != nil {
+		return nil, fmt.Errorf("invalid claims: %v", err)
+	}
+
+	for _, aud := range a.audience {
+		if c.Audience.Contains(aud) {
+			return claims, nil
+		}
+	}
+	return nil, fmt.Errorf("audience %v not in %v", c.Audience, a.audience)
+}
+
+// StaticToken is a pre-shared bearer token accepted by ProviderStatic.
+type StaticToken struct {
+	// Subject identifies the holder of the token.
+	Subject string
+
+	// Scope is the space-separated scopes granted to the token.
+	Scope string
+}
+
+// ParseStaticTokens parses comma-separated subject=token[:scopes] entries
+// into a map from token to StaticToken. scopes is a '+'-separated list of
+// scopes; entries without scopes are granted scope, a space-separated list of
+// scopes. Tokens may not contain ',' or ':'.
+func ParseStaticTokens(s, scope string) (map[string]StaticToken, error) {
+	m := make(map[string]StaticToken)
+	for _, e := range strings.Split(s, ",") {
+		i := strings.Index(e, "=")
+		if i < 1 || i == len(e)-1 {
+			return nil, fmt.Errorf("malformed static token %q, want subject=token[:scopes]", e)
+		}
+		t := StaticToken{Subject: e[:i], Scope: scope}
+		token := e[i+1:]
+		if j := strings.Index(token, ":"); j >= 0 {
+			t.Scope = strings.Replace(token[j+1:], "+", " ", -1)
+			token = token[:j]
+		}
+		if token == "" || t.Scope == "" {
+			return nil, fmt.Errorf("malformed static token %q, want subject=token[:scopes]", e)
+		}
+		m[token] = t
+	}
+	return m, nil
+}
+
+// ParseSubjectScopes parses comma-separated subject=scopes entries into a map
+// from subject to space-separated scopes. scopes is a '+'-separated list of
+// scopes.
+func ParseSubjectScopes(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if s == "" {
+		return m, nil
+	}
+	for _, e := range strings.Split(s, ",") {
+		i := strings.Index(e, "=")
+		if i < 1 || i == len(e)-1 {
+			return nil, fmt.Errorf("malformed subject scopes %q, want subject=scopes", e)
+		}
+		m[e[:i]] = strings.Replace(e[i+1:], "+", " ", -1)
+	}
+	return m, nil
+}
+
+// staticAuthenticator authenticates pre-shared bearer tokens.
+type staticAuthenticator struct {
+	// tokens maps tokens to their subject and scope.
+	tokens map[string]StaticToken
+}
+
+// NewStaticAuthenticator creates an Authenticator for ProviderStatic, which
+// accepts the bearer tokens in tokens, granting each its StaticToken subject
+// and scope.
+func NewStaticAuthenticator(tokens map[string]StaticToken) Authenticator {
+	return &staticAuthenticator{
+		tokens: tokens,
+	}
+}
+
+// Authenticate implements Authenticator.Authenticate.
+func (a *staticAuthenticator) Authenticate(r *http.Request) (Claims, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	got := []byte(strings.TrimPrefix(h, "Bearer "))
+
+	// Check every token, so the time taken doesn't reveal which matched.
+	var match StaticToken
+	var found bool
+	for t, st := range a.tokens {
+		if subtle.ConstantTimeCompare(got, []byte(t)) == 1 {
+			match = st
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown token")
+	}
+
+	return Claims{
+		"sub":   match.Subject,
+		"scope": match.Scope,
+	}, nil
+}
+
+// mtlsAuthenticator authenticates TLS client certificates.
+type mtlsAuthenticator struct {
+	// scopes maps subjects to their space-separated scopes.
+	scopes map[string]string
+
+	// scope is the space-separated scopes granted to certificates whose
+	// subject is not in scopes.
+	scope string
+}
+
+// NewMTLSAuthenticator creates an Authenticator for ProviderMTLS, which
+// accepts requests with a client certificate verified by the TLS server. The
+// subject is the certificate common name. Certificates are granted the
+// space-separated scopes of their subject in scopes, or scope if it is
+// missing.
+//
+// The server must terminate TLS itself and request client certificates; it
+// cannot be used behind a TLS-terminating proxy.
+func NewMTLSAuthenticator(scopes map[string]string, scope string) Authenticator {
+	return &mtlsAuthenticator{
+		scopes: scopes,
+		scope:  scope,
+	}
+}
+
+// Authenticate implements Authenticator.Authenticate.
+func (a *mtlsAuthenticator) Authenticate(r *http.Request) (Claims, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, fmt.Errorf("missing verified client certificate")
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil, fmt.Errorf("client certificate %v missing common name", cert.Subject)
+	}
+
+	scope, ok := a.scopes[cert.Subject.CommonName]
+	if !ok {
+		scope = a.scope
+	}
+
+	return Claims{
+		"sub":   cert.Subject.CommonName,
+		"scope": scope,
+	}, nil
+}
@@ -0,0 +1,302 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// minRefreshMargin is the minimum time before expiry at which cached tokens
+// are refreshed. Tokens are also refreshed once less than a tenth of their
+// lifetime remains.
+const minRefreshMargin = 5 * time.Minute
+
+// cachedToken is the on-disk format of a cached access token.
+type cachedToken struct {
+	// ClientID, Audience, TokenURL and Scopes identify the credentials
+	// and request the token was issued for, so that changed credentials
+	// don't use a stale token.
+	ClientID string
+	Audience string
+	TokenURL string
+	Scopes   []string
+
+	AccessToken string
+	TokenType   string
+
+	// Obtained is when the token was obtained.
+	Obtained time.Time
+
+	// Expiry is when the token expires.
+	Expiry time.Time
+}
+
+// fresh returns true if c is valid and does not need to be refreshed yet.
+// Tokens without an expiry never expire.
+func (c *cachedToken) fresh() bool {
+	if c.AccessToken == "" {
+		return false
+	}
+	if c.Expiry.IsZero() {
+		return true
+	}
+
+	margin := c.Expiry.Sub(c.Obtained) / 10
+	if margin < minRefreshMargin {
+		margin = minRefreshMargin
+	}
+	return time.Now().Add(margin).Before(c.Expiry)
+}
+
+// valid returns true if c has not expired.
+func (c *cachedToken) valid() bool {
+	return c.AccessToken != "" && time.Now().Add(time.Minute).Before(c.Expiry)
+}
+
+// token returns c as an oauth2.Token.
+func (c *cachedToken) token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken: c.AccessToken,
+		TokenType:   c.TokenType,
+		Expiry:      c.Expiry,
+	}
+}
+
+// cachingTokenSource implements oauth2.TokenSource, caching tokens from src
+// in memory and in a file, so that tokens are reused across client runs.
+// Tokens are refreshed proactively, before they expire.
+type cachingTokenSource struct {
+	// path is the cache file, or empty if tokens are only cached in
+	// memory.
+	path string
+
+	// conf are the credentials src uses.
+	conf ClientConfig
+
+	// src provides new tokens.
+	src oauth2.TokenSource
+
+	// mu protects cur.
+	mu sync.Mutex
+
+	// cur is the current token, or nil if none has been read or
+	// obtained yet.
+	cur *cachedToken
+}
+
+// newCachingTokenSource returns a cachingTokenSource for tokens from src,
+// cached in conf.CacheFile.
+func newCachingTokenSource(conf ClientConfig, src oauth2.TokenSource) *cachingTokenSource {
+	return &cachingTokenSource{
+		path: conf.CacheFile,
+		conf: conf,
+		src:  src,
+	}
+}
+
+// matches returns true if c was issued for the credentials and scopes of t.
+func (t *cachingTokenSource) matches(c *cachedToken) bool {
+	if c.ClientID != t.conf.ClientID || c.Audience != t.conf.Audience || c.TokenURL != t.conf.TokenURL {
+		return false
+	}
+	if len(c.Scopes) != len(t.conf.Scopes) {
+		return false
+	}
+	for i := range c.Scopes {
+		if c.Scopes[i] != t.conf.Scopes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidate discards the current token, in memory and in the cache file, so
+// that the next call to Token obtains a new one.
+func (t *cachingTokenSource) invalidate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cur = nil
+	if t.path == "" {
+		return
+	}
+	if err := os.Remove(t.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove token cache: %v", err)
+	}
+}
+
+// read reads the cache file. It returns nil if there is no usable cached
+// token.
+func (t *cachingTokenSource) read() *cachedToken {
+	if t.path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Printf("Unable to read token cache: %v", err)
+		return nil
+	}
+
+	var c cachedToken
+	if err := json.Unmarshal(b, &c); err != nil {
+		log.Printf("Ignoring malformed token cache: %v", err)
+		return nil
+	}
+	if !t.matches(&c) {
+		return nil
+	}
+	return &c
+}
+
+// write writes c to the cache file, readable only by the current user.
+func (t *cachingTokenSource) write(c *cachedToken) error {
+	if t.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("error encoding token: %v", err)
+	}
+
+	dir := filepath.Dir(t.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating cache directory: %v", err)
+	}
+
+	// ioutil.TempFile creates the file with mode 0600.
+	f, err := ioutil.TempFile(dir, filepath.Base(t.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing token cache: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing token cache: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), t.path); err != nil {
+		return fmt.Errorf("error replacing token cache: %v", err)
+	}
+	return nil
+}
+
+// Token implements oauth2.TokenSource.Token.
+func (t *cachingTokenSource) Token() (*oauth2.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cur == nil {
+		t.cur = t.read()
+	}
+	if t.cur != nil && t.cur.fresh() {
+		return t.cur.token(), nil
+	}
+
+	tok, err := t.src.Token()
+	if err != nil {
+		// A proactive refresh can fail without consequence while the
+		// current token is still valid.
+		if t.cur != nil && t.cur.valid() {
+			log.Printf("Unable to refresh token, using current token: %v", err)
+			return t.cur.token(), nil
+		}
+		return nil, err
+	}
+
+	t.cur = &cachedToken{
+		ClientID:    t.conf.ClientID,
+		Audience:    t.conf.Audience,
+		TokenURL:    t.conf.TokenURL,
+		Scopes:      t.conf.Scopes,
+		AccessToken: tok.AccessToken,
+		TokenType:   tok.TokenType,
+		Obtained:    time.Now(),
+		Expiry:      tok.Expiry,
+	}
+
+	if tok.Expiry.IsZero() {
+		// Don't reuse tokens without an expiry in later runs, which
+		// may long outlive them.
+		return tok, nil
+	}
+
+	if err := t.write(t.cur); err != nil {
+		log.Printf("Unable to cache token: %v", err)
+	}
+
+	return tok, nil
+}
+
+// newCachingClient returns an http.Client authenticating with tokens from src,
+// cached as described by cachingTokenSource.
+//
+// A cached token may be rejected before it expires, for example because the
+// scopes of the credentials changed. Requests rejected with 401 Unauthorized
+// discard the token and are retried once with a new one.
+func newCachingClient(ctx context.Context, conf ClientConfig, src oauth2.TokenSource) *http.Client {
+	ts := newCachingTokenSource(conf, src)
+	return &http.Client{
+		Transport: &unauthorizedTransport{
+			base: &oauth2.Transport{
+				Source: ts,
+				Base:   httpClient(ctx).Transport,
+			},
+			ts: ts,
+		},
+	}
+}
+
+// unauthorizedTransport implements http.RoundTripper, obtaining a new token
+// when a request is rejected as unauthorized.
+type unauthorizedTransport struct {
+	// base sends requests with a token from ts.
+	base http.RoundTripper
+
+	// ts is the token source of base.
+	ts *cachingTokenSource
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip.
+func (u *unauthorizedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := u.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	log.Printf("Access token rejected, obtaining a new token")
+	u.ts.invalidate()
+
+	// Retry only if the body can be sent again.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	retry := new(http.Request)
+	*retry = *req
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+
+	resp.Body.Close()
+	return u.base.RoundTrip(retry)
+}
@@ -0,0 +1,39 @@
+package auth0
+
+import (
+	"context"
+	"net/http"
+)
+
+// Claims are the claims of a validated access token.
+type Claims map[string]interface{}
+
+// String returns the string claim name, or "" if it is missing or not a
+// string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Subject returns the subject ("sub") of the token.
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+// contextKey is the type of request context keys.
+type contextKey int
+
+// claimsKey is the request context key of the Claims.
+const claimsKey contextKey = 0
+
+// RequestClaims returns the claims of the access token validated for r by
+// Validator.ValidateWithScopes, if any.
+func RequestClaims(r *http.Request) (Claims, bool) {
+	c, ok := r.Context().Value(claimsKey).(Claims)
+	return c, ok
+}
+
+// withClaims returns a copy of r carrying claims c.
+func withClaims(r *http.Request, c Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey, c))
+}
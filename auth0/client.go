@@ -1,5 +1,9 @@
-// Package auth0 provides helpers to send Auth0 credentials from a client and
-// validate Auth0 credentials on a server.
+// Package auth0 provides helpers to send credentials from a client and
+// validate credentials on a server.
+//
+// Despite the name, Auth0 is only one of the supported providers. Generic
+// OIDC/OAuth2 client credentials, static bearer tokens, and mutual TLS client
+// certificates are also supported.
 package auth0
 
 import (
@@ -30,8 +34,12 @@ type tokenResponse struct {
 	ExpiresIn   uint64 `json:"expires_in"`
 }
 
-// ClientConfig describes an Auth0 client credentials flow.
+// ClientConfig describes how a client authenticates.
 type ClientConfig struct {
+	// Provider is the authentication provider, one of the Provider
+	// constants. Defaults to ProviderAuth0.
+	Provider string
+
 	// ClientID is the client's id.
 	ClientID string `mapstructure:"client-id"`
 
@@ -41,10 +49,34 @@ type ClientConfig struct {
 	// Audience is the unique ID of the target API to access.
 	Audience string
 
-	// TokenURL is the /oauth/token URL for the Auth0 account.
+	// TokenURL is the /oauth/token URL for the Auth0 account, or the
+	// token endpoint of the OIDC provider.
 	TokenURL string `mapstructure:"token-url"`
+
+	// Scopes are the scopes to request from the OIDC provider.
+	Scopes []string
+
+	// Token is the pre-shared bearer token for ProviderStatic.
+	Token string
+
+	// CertFile and KeyFile are the PEM client certificate and key for
+	// ProviderMTLS.
+	CertFile string `mapstructure:"cert-file"`
+	KeyFile  string `mapstructure:"key-file"`
+
+	// CAFile is an optional PEM CA bundle used to verify the server for
+	// ProviderMTLS, instead of the system roots.
+	CAFile string `mapstructure:"ca-file"`
+
+	// CacheFile is the path of the on-disk cache of access tokens for
+	// ProviderAuth0 and ProviderOIDC, which lets short-lived processes
+	// reuse tokens. If empty, tokens are only cached in memory.
+	CacheFile string `mapstructure:"-"`
 }
 
+// tokenTimeout is the deadline for token requests.
+const tokenTimeout = 30 * time.Second
+
 // tokenSource implements oauth2.TokenSource.
 type tokenSource struct {
 	ctx  context.Context
@@ -72,7 +104,10 @@ func (t *tokenSource) Token() (*oauth2.Token, error) {
 
 	req.Header.Add("content-type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	ctx, cancel := context.WithTimeout(t.ctx, tokenTimeout)
+	defer cancel()
+
+	res, err := httpClient(ctx).Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get token: error sending HTTP request %+v: %v", req, err)
 	}
@@ -99,9 +134,9 @@ func (t *tokenSource) Token() (*oauth2.Token, error) {
 	}, nil
 }
 
-// NewClient returns an http.Client using a token obtained from Auth0. The
-// token will auto-refresh as necessary.
-func NewClient(ctx context.Context, conf ClientConfig) (*http.Client, error) {
+// newAuth0Client returns an http.Client using a token obtained from Auth0.
+// The token will auto-refresh as necessary, and is cached in conf.CacheFile.
+func newAuth0Client(ctx context.Context, conf ClientConfig) (*http.Client, error) {
 	if conf.ClientID == "" {
 		return nil, fmt.Errorf("client ID must be provided")
 	}
@@ -119,5 +154,5 @@ func NewClient(ctx context.Context, conf ClientConfig) (*http.Client, error) {
 		ctx:  ctx,
 		conf: conf,
 	}
-	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(nil, t)), nil
+	return newCachingClient(ctx, conf, t), nil
 }
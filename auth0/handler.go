@@ -6,28 +6,24 @@ import (
 	"log"
 	"net/http"
 	"strings"
-
-	gauth0 "github.com/auth0-community/go-auth0"
-	jose "gopkg.in/square/go-jose.v2"
-	jwt "gopkg.in/square/go-jose.v2/jwt"
 )
 
+// Authenticator authenticates requests for a Validator.
+type Authenticator interface {
+	// Authenticate returns the claims of the credentials in r, or an
+	// error if they are missing or invalid.
+	Authenticate(r *http.Request) (Claims, error)
+}
+
 // Validator performs server-side validation of access tokens.
 type Validator struct {
-	v *gauth0.JWTValidator
+	a Authenticator
 }
 
-// NewValidator creates a Validator that validates access tokens.
-//
-// jwks is the URL of the JWKS keys for the API.
-// issuer is the API issuer.
-// audience are the unique identifiers of the APIs being validated.
-func NewValidator(jwks, issuer string, audience []string) *Validator {
-	sp := NewSecretProvider(jwks)
-	c := gauth0.NewConfiguration(sp, audience, issuer, jose.RS256)
-
+// NewValidator creates a Validator that validates requests with a.
+func NewValidator(a Authenticator) *Validator {
 	return &Validator{
-		v: gauth0.NewValidator(c),
+		a: a,
 	}
 }
 
@@ -41,13 +37,14 @@ type MethodScopes map[string][]string
 
 // ValidateWithScope returns an http.Handler which validates that all requests
 // have a valid access token with the specified scopes before calling into h.
+// The token claims are available to h via RequestClaims.
 //
 // No scopes are checked if scopes is nil.
 //
 // Invalid requests receive a 401 response.
 func (v *Validator) ValidateWithScopes(scopes MethodScopes, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		t, err := v.v.ValidateRequest(r)
+		claims, err := v.a.Authenticate(r)
 		if err != nil {
 			log.Printf("Token is not valid or missing token: %v", err)
 
@@ -74,8 +71,8 @@ func (v *Validator) ValidateWithScopes(scopes MethodScopes, h http.Handler) http
 
 			if len(mscopes) > 0 {
 				// Ensure the token has the correct scopes.
-				if err := v.checkScopes(r, t, mscopes); err != nil {
-					log.Printf("Scopes from %+v not ok want %v: %v", t, mscopes, err)
+				if err := checkScopes(claims, mscopes); err != nil {
+					log.Printf("Scopes from %q not ok want %v: %v", claims.Subject(), mscopes, err)
 
 					w.WriteHeader(http.StatusUnauthorized)
 					json.NewEncoder(w).Encode(errorResponse{
@@ -88,17 +85,13 @@ func (v *Validator) ValidateWithScopes(scopes MethodScopes, h http.Handler) http
 		}
 
 		// We have a valid token and all desired tokens. Good to go!
-		h.ServeHTTP(w, r)
+		// Handlers may use the claims via RequestClaims.
+		h.ServeHTTP(w, withClaims(r, claims))
 	})
 }
 
-// checkScopes validates that t contains all of wantScopes.
-func (v *Validator) checkScopes(r *http.Request, t *jwt.JSONWebToken, wantScopes []string) error {
-	claims := map[string]interface{}{}
-	if err := v.v.Claims(r, t, &claims); err != nil {
-		return fmt.Errorf("error retrieving claims from %+v: %v", t, err)
-	}
-
+// checkScopes validates that claims contain all of wantScopes.
+func checkScopes(claims Claims, wantScopes []string) error {
 	s, ok := claims["scope"]
 	if !ok {
 		return fmt.Errorf("claims missing scope: %+v", claims)
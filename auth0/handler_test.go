@@ -0,0 +1,116 @@
+package auth0
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseStaticTokens(t *testing.T) {
+	got, err := ParseStaticTokens("laptop=secret1,ci=secret2:read:release+write:release", "read:release write:events")
+	if err != nil {
+		t.Fatalf("ParseStaticTokens got err %v want nil", err)
+	}
+
+	want := map[string]StaticToken{
+		"secret1": {Subject: "laptop", Scope: "read:release write:events"},
+		"secret2": {Subject: "ci", Scope: "read:release write:release"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseStaticTokens got %+v want %+v", got, want)
+	}
+
+	for _, s := range []string{"", "laptop", "=secret", "laptop=", "laptop=:read:release", "laptop=secret:"} {
+		if _, err := ParseStaticTokens(s, "read:release"); err == nil {
+			t.Errorf("ParseStaticTokens(%q) got nil err want error", s)
+		}
+	}
+}
+
+func TestValidateWithScopesStatic(t *testing.T) {
+	tokens, err := ParseStaticTokens("laptop=secret1,reader=secret2:read:release", "read:release write:events")
+	if err != nil {
+		t.Fatalf("ParseStaticTokens got err %v want nil", err)
+	}
+	v := NewValidator(NewStaticAuthenticator(tokens))
+
+	scopes := MethodScopes{
+		"GET":  []string{"read:release"},
+		"POST": []string{"write:events"},
+	}
+	var claims Claims
+	h := v.ValidateWithScopes(scopes, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ = RequestClaims(r)
+	}))
+
+	cases := []struct {
+		name   string
+		method string
+		token  string
+		code   int
+		sub    string
+	}{
+		{name: "missing token", method: "GET", code: http.StatusUnauthorized},
+		{name: "unknown token", method: "GET", token: "secret3", code: http.StatusUnauthorized},
+		{name: "default scope", method: "POST", token: "secret1", code: http.StatusOK, sub: "laptop"},
+		{name: "token scope", method: "GET", token: "secret2", code: http.StatusOK, sub: "reader"},
+		{name: "missing scope", method: "POST", token: "secret2", code: http.StatusUnauthorized},
+		{name: "missing method", method: "DELETE", token: "secret1", code: http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		claims = nil
+
+		r := httptest.NewRequest(c.method, "/", nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("%s: got code %d want %d", c.name, w.Code, c.code)
+		}
+		if got := claims.Subject(); got != c.sub {
+			t.Errorf("%s: got subject %q want %q", c.name, got, c.sub)
+		}
+	}
+}
+
+func TestMTLSScopes(t *testing.T) {
+	scopes, err := ParseSubjectScopes("admin=read:release+write:release")
+	if err != nil {
+		t.Fatalf("ParseSubjectScopes got err %v want nil", err)
+	}
+	a := NewMTLSAuthenticator(scopes, "read:release write:events")
+
+	cases := []struct {
+		cn    string
+		scope string
+	}{
+		{cn: "admin", scope: "read:release write:release"},
+		{cn: "laptop", scope: "read:release write:events"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: c.cn}}}},
+		}
+
+		claims, err := a.Authenticate(r)
+		if err != nil {
+			t.Errorf("%s: Authenticate got err %v want nil", c.cn, err)
+			continue
+		}
+		if got := claims.String("scope"); got != c.scope {
+			t.Errorf("%s: got scope %q want %q", c.cn, got, c.scope)
+		}
+	}
+
+	if _, err := a.Authenticate(httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Errorf("Authenticate without certificate got nil err want error")
+	}
+}
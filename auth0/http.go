@@ -16,3 +16,9 @@ func requestContext(r *http.Request) context.Context {
 func httpClient(context.Context) *http.Client {
 	return http.DefaultClient
 }
+
+// background runs f in a new goroutine, which may outlive the request
+// with context ctx.
+func background(ctx context.Context, f func(context.Context)) {
+	go f(context.Background())
+}
@@ -19,3 +19,9 @@ func requestContext(r *http.Request) context.Context {
 func httpClient(ctx context.Context) *http.Client {
 	return urlfetch.Client(ctx)
 }
+
+// background runs f with context ctx. App Engine does not permit goroutines
+// to outlive requests, so f runs synchronously.
+func background(ctx context.Context, f func(context.Context)) {
+	f(ctx)
+}
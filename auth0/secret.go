@@ -27,24 +27,67 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	gauth0 "github.com/auth0-community/go-auth0"
 	jose "gopkg.in/square/go-jose.v2"
 )
 
-// SecretProvider implements gauth0.SecretProvider. It is nearly identical to
-// gauth0.JWKClient, except that it works on App Engine.
+const (
+	// minRefreshInterval is the minimum time between JWKS downloads. It
+	// limits how often unknown key IDs can trigger a download.
+	minRefreshInterval = time.Minute
+
+	// defaultRefreshInterval is how long keys are used before they are
+	// refreshed if the JWKS response has no Cache-Control max-age.
+	defaultRefreshInterval = time.Hour
+
+	// maxRefreshInterval is the maximum time keys are used before they
+	// are refreshed, regardless of Cache-Control.
+	maxRefreshInterval = 24 * time.Hour
+
+	// missingTTL is how long an unknown key ID is remembered as missing,
+	// during which it does not trigger downloads.
+	missingTTL = 5 * time.Minute
+)
+
+// Algorithms are the supported token signature algorithms.
+var Algorithms = []jose.SignatureAlgorithm{jose.RS256, jose.ES256, jose.EdDSA}
+
+// SecretProvider implements gauth0.SecretProvider. It is similar to
+// gauth0.JWKClient, except that it works on App Engine and caches keys.
+//
+// Keys are refreshed in the background once the JWKS Cache-Control max-age
+// expires, dropping any keys that are no longer published. Unknown key IDs
+// trigger a refresh, at most once per minRefreshInterval.
 type SecretProvider struct {
 	// jwksURL is the URL from which to download keys.
 	jwksURL string
 
-	// mu protects the fields below.
+	// refreshMu serializes downloads.
+	refreshMu sync.Mutex
+
+	// mu protects the fields below. It is not held during downloads.
 	mu sync.Mutex
 
-	// keys contains the known keys, which are downloaded as needed.
+	// keys contains the known keys, by ID.
 	keys map[string]jose.JSONWebKey
+
+	// fetched is the time of the last download attempt.
+	fetched time.Time
+
+	// expires is the time after which keys should be refreshed.
+	expires time.Time
+
+	// refreshing is true while a background refresh is running.
+	refreshing bool
+
+	// missing contains the time unknown key IDs were last looked up
+	// without being found.
+	missing map[string]time.Time
 }
 
 // NewSecretProvider returns a SecretProvider that fetchs keys from the
@@ -53,67 +96,219 @@ func NewSecretProvider(url string) *SecretProvider {
 	return &SecretProvider{
 		jwksURL: url,
 		keys:    make(map[string]jose.JSONWebKey),
+		missing: make(map[string]time.Time),
 	}
 }
 
-// getKey looks up the key for ID.
-func (s *SecretProvider) getKey(ctx context.Context, ID string) (jose.JSONWebKey, bool) {
+// lookup returns the key for ID, whether it exists, and whether the keys
+// should be refreshed.
+func (s *SecretProvider) lookup(ID string) (jose.JSONWebKey, bool, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	key, exist := s.keys[ID]
+	return key, exist, time.Now().After(s.expires)
+}
 
-	if !exist {
-		// TODO(prattmic): don't continuously re-download if we keep
-		// receiving invalid keys.
-		if err := s.downloadKeys(ctx); err != nil {
-			log.Printf("Error downloading keys: %v", err)
+// getKey looks up the key for ID.
+func (s *SecretProvider) getKey(ctx context.Context, ID string) (jose.JSONWebKey, bool) {
+	key, exist, stale := s.lookup(ID)
+	if exist {
+		if stale {
+			// Keep using the existing keys until the refresh
+			// completes.
+			s.refreshBackground(ctx)
 		}
+		return key, true
+	}
+
+	// This may be a new key after rotation, or just garbage. Don't keep
+	// re-downloading for the same unknown key.
+	s.mu.Lock()
+	t, missing := s.missing[ID]
+	s.mu.Unlock()
+	if missing && time.Since(t) < missingTTL {
+		return jose.JSONWebKey{}, false
 	}
 
-	key, exist = s.keys[ID]
+	downloaded := s.refresh(ctx)
+
+	// Only a download can show that the key is missing. If the refresh
+	// was rate limited, the key may still be published.
+	key, exist, _ = s.lookup(ID)
+	if !exist && downloaded {
+		s.mu.Lock()
+		s.missing[ID] = time.Now()
+		s.mu.Unlock()
+	}
 	return key, exist
 }
 
-// downloadKeys fetchs keys from the JWKS URL.
-func (s *SecretProvider) downloadKeys(ctx context.Context) error {
+// refreshBackground refreshes the keys in the background, if a refresh is
+// not already running.
+func (s *SecretProvider) refreshBackground(ctx context.Context) {
+	s.mu.Lock()
+	if s.refreshing {
+		s.mu.Unlock()
+		return
+	}
+	s.refreshing = true
+	s.mu.Unlock()
+
+	background(ctx, func(ctx context.Context) {
+		s.refresh(ctx)
+
+		s.mu.Lock()
+		s.refreshing = false
+		s.mu.Unlock()
+	})
+}
+
+// refresh downloads the keys, unless they were downloaded less than
+// minRefreshInterval ago. It returns true if the keys were downloaded.
+func (s *SecretProvider) refresh(ctx context.Context) bool {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	// Callers waiting on refreshMu will find the keys were just
+	// downloaded.
+	s.mu.Lock()
+	recent := time.Since(s.fetched) < minRefreshInterval
+	s.mu.Unlock()
+	if recent {
+		return false
+	}
+
+	keys, maxAge, err := s.downloadKeys(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.fetched = now
+	if err != nil {
+		// Keep the existing keys, and retry soon.
+		log.Printf("Error downloading keys: %v", err)
+		s.expires = now.Add(minRefreshInterval)
+		return false
+	}
+
+	// Replace the keys entirely, so keys that are no longer published
+	// are removed.
+	s.keys = keys
+	s.expires = now.Add(maxAge)
+	for id, t := range s.missing {
+		if _, ok := keys[id]; ok || now.Sub(t) >= missingTTL {
+			delete(s.missing, id)
+		}
+	}
+	return true
+}
+
+// cacheMaxAge returns how long keys from a response with Cache-Control header
+// h should be used before they are refreshed.
+func cacheMaxAge(h string) time.Duration {
+	d := defaultRefreshInterval
+	for _, directive := range strings.Split(h, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return minRefreshInterval
+		case strings.HasPrefix(directive, "max-age="):
+			secs, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64)
+			if err != nil {
+				log.Printf("Malformed Cache-Control %q: %v", h, err)
+				continue
+			}
+			d = time.Duration(secs) * time.Second
+		}
+	}
+
+	if d < minRefreshInterval {
+		d = minRefreshInterval
+	}
+	if d > maxRefreshInterval {
+		d = maxRefreshInterval
+	}
+	return d
+}
+
+// downloadKeys fetchs keys from the JWKS URL. It returns the signing keys and
+// how long to use them before refreshing.
+func (s *SecretProvider) downloadKeys(ctx context.Context) (map[string]jose.JSONWebKey, time.Duration, error) {
 	c := httpClient(ctx)
 
 	r, err := c.Get(s.jwksURL)
 	if err != nil {
-		return fmt.Errorf("failed to fetch %s: %v", s.jwksURL, err)
+		return nil, 0, fmt.Errorf("failed to fetch %s: %v", s.jwksURL, err)
 	}
 	defer r.Body.Close()
 
+	if r.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("failed to fetch %s: status %s", s.jwksURL, r.Status)
+	}
+
 	if h := r.Header.Get("Content-Type"); !strings.HasPrefix(h, "application/json") {
-		return gauth0.ErrInvalidContentType
+		return nil, 0, gauth0.ErrInvalidContentType
 	}
 
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+		return nil, 0, fmt.Errorf("failed to read response body: %v", err)
 	}
 
 	var jwks gauth0.JWKS
 	if err = json.Unmarshal(b, &jwks); err != nil {
-		return fmt.Errorf("failed to unmarshal %q: %v", string(b), err)
+		return nil, 0, fmt.Errorf("failed to unmarshal %q: %v", string(b), err)
 	}
 
-	if len(jwks.Keys) < 1 {
-		return gauth0.ErrNoKeyFound
+	keys := make(map[string]jose.JSONWebKey, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if key.Use == "enc" || !key.Valid() {
+			continue
+		}
+		keys[key.KeyID] = key
 	}
 
-	for _, key := range jwks.Keys {
-		s.keys[key.KeyID] = key
+	if len(keys) < 1 {
+		return nil, 0, gauth0.ErrNoKeyFound
+	}
+
+	return keys, cacheMaxAge(r.Header.Get("Cache-Control")), nil
+}
+
+// supported returns true if alg is one of Algorithms.
+func supported(alg string) bool {
+	for _, a := range Algorithms {
+		if string(a) == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// verificationKey returns the key to verify a token with header h.
+func (s *SecretProvider) verificationKey(ctx context.Context, h jose.Header) (interface{}, error) {
+	if !supported(h.Algorithm) {
+		return nil, gauth0.ErrInvalidAlgorithm
+	}
+
+	key, ok := s.getKey(ctx, h.KeyID)
+	if !ok {
+		return nil, gauth0.ErrNoKeyFound
+	}
+
+	// Don't let the token choose a different algorithm than the key is
+	// intended for.
+	if key.Algorithm != "" && key.Algorithm != h.Algorithm {
+		return nil, fmt.Errorf("token algorithm %s does not match key algorithm %s", h.Algorithm, key.Algorithm)
 	}
 
-	return nil
+	return key.Key, nil
 }
 
 // GetSecret implements gauth0.SecretProvider.GetSecret.
 func (s *SecretProvider) GetSecret(req *http.Request) (interface{}, error) {
-	ctx := requestContext(req)
-
 	t, err := gauth0.FromHeader(req)
 	if err != nil {
 		return nil, err
@@ -123,15 +318,5 @@ func (s *SecretProvider) GetSecret(req *http.Request) (interface{}, error) {
 		return nil, gauth0.ErrInvalidTokenHeader
 	}
 
-	header := t.Headers[0]
-	if header.Algorithm != "RS256" {
-		return nil, gauth0.ErrInvalidAlgorithm
-	}
-
-	key, ok := s.getKey(ctx, header.KeyID)
-	if !ok {
-		return nil, gauth0.ErrNoKeyFound
-	}
-
-	return key.Key, nil
+	return s.verificationKey(requestContext(req), t.Headers[0])
 }
@@ -0,0 +1,155 @@
+package auth0
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// jwksServer serves a JWKS that can be replaced, counting downloads.
+type jwksServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	keys      []jose.JSONWebKey
+	downloads int
+}
+
+func newJWKSServer(keys ...jose.JSONWebKey) *jwksServer {
+	j := &jwksServer{keys: keys}
+	j.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.downloads++
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: j.keys})
+	}))
+	return j
+}
+
+// rotate replaces the published keys.
+func (j *jwksServer) rotate(keys ...jose.JSONWebKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = keys
+}
+
+// count returns the number of downloads.
+func (j *jwksServer) count() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.downloads
+}
+
+// newKey returns a new ES256 public key with ID id.
+func newKey(t *testing.T, id string) jose.JSONWebKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey got err %v want nil", err)
+	}
+	return jose.JSONWebKey{
+		Key:       &k.PublicKey,
+		KeyID:     id,
+		Algorithm: string(jose.ES256),
+		Use:       "sig",
+	}
+}
+
+// age makes the last download of s look older than minRefreshInterval, so the
+// next refresh downloads again.
+func age(s *SecretProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetched = s.fetched.Add(-minRefreshInterval)
+}
+
+func TestSecretProviderRotation(t *testing.T) {
+	ctx := context.Background()
+
+	k1 := newKey(t, "k1")
+	k2 := newKey(t, "k2")
+	j := newJWKSServer(k1)
+	defer j.Close()
+
+	s := NewSecretProvider(j.URL)
+
+	check := func(id string, want *jose.JSONWebKey, downloads int) {
+		t.Helper()
+		got, err := s.verificationKey(ctx, jose.Header{KeyID: id, Algorithm: string(jose.ES256)})
+		if want == nil {
+			if err == nil {
+				t.Errorf("verificationKey(%s) got nil err want error", id)
+			}
+		} else if err != nil {
+			t.Errorf("verificationKey(%s) got err %v want nil", id, err)
+		} else if !reflect.DeepEqual(got, want.Key) {
+			t.Errorf("verificationKey(%s) got %v want %v", id, got, want.Key)
+		}
+		if got := j.count(); got != downloads {
+			t.Errorf("after verificationKey(%s) got %d downloads want %d", id, got, downloads)
+		}
+	}
+
+	start := time.Now()
+	check("k1", &k1, 1)
+
+	// Cache-Control max-age sets the expiry.
+	s.mu.Lock()
+	expires := s.expires
+	s.mu.Unlock()
+	if min, max := start.Add(600*time.Second), time.Now().Add(600*time.Second); expires.Before(min) || expires.After(max) {
+		t.Errorf("expires got %v want between %v and %v", expires, min, max)
+	}
+
+	// Unknown keys don't download again within minRefreshInterval.
+	check("unknown", nil, 1)
+	check("unknown", nil, 1)
+
+	// The rotated key isn't seen until the rate limit allows a download,
+	// but a rate limited lookup doesn't mark it missing.
+	j.rotate(k2)
+	check("k2", nil, 1)
+	age(s)
+	check("k2", &k2, 2)
+
+	// The removed key is rejected.
+	check("k1", nil, 2)
+
+	// An unknown key that was looked for in a download is remembered as
+	// missing for missingTTL, even once downloads are allowed again.
+	age(s)
+	check("unknown", nil, 3)
+	age(s)
+	check("unknown", nil, 3)
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	cases := []struct {
+		h    string
+		want time.Duration
+	}{
+		{h: "", want: defaultRefreshInterval},
+		{h: "public, max-age=600", want: 600 * time.Second},
+		{h: "max-age=1", want: minRefreshInterval},
+		{h: "max-age=31536000", want: maxRefreshInterval},
+		{h: "no-cache", want: minRefreshInterval},
+		{h: "max-age=bogus", want: defaultRefreshInterval},
+	}
+	for _, c := range cases {
+		if got := cacheMaxAge(c.h); got != c.want {
+			t.Errorf("cacheMaxAge(%q) got %v want %v", c.h, got, c.want)
+		}
+	}
+}
@@ -1,18 +1,19 @@
 package binver
 
 import (
+	"context"
 	"os/exec"
 	"strings"
 )
 
-func Client(bin string) (string, error) {
-	cmd := exec.Command(bin, "--version")
+func Client(ctx context.Context, bin string) (string, error) {
+	cmd := exec.CommandContext(ctx, bin, "--version")
 	b, err := cmd.Output()
 	return strings.Trim(string(b), "\r\n"), err
 }
 
-func Restic(bin string) (string, error) {
-	cmd := exec.Command(bin, "version")
+func Restic(ctx context.Context, bin string) (string, error) {
+	cmd := exec.CommandContext(ctx, bin, "version")
 	b, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -24,4 +25,3 @@ func Restic(bin string) (string, error) {
 	s = strings.SplitN(s, "\n", 2)[0]
 	return strings.Trim(s, "\r\n"), nil
 }
-
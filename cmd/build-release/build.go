@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -36,7 +37,7 @@ func buildRestic(root, release string) (string, error) {
 
 	// Find the version.
 	glog.Infof("Determing restic version...")
-	version, err := binver.Restic(bin)
+	version, err := binver.Restic(context.Background(), bin)
 	if err != nil {
 		return "", fmt.Errorf("error finding version: %v", err)
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
@@ -27,13 +28,13 @@ func findVersions(release string) (*versions, error) {
 	ver.release = string(b)
 
 	glog.Infof("Finding restic version...")
-	ver.restic, err = binver.Restic(filepath.Join(release, "restic"))
+	ver.restic, err = binver.Restic(context.Background(), filepath.Join(release, "restic"))
 	if err != nil {
 		return nil, fmt.Errorf("error reading restic version: %v", err)
 	}
 
 	glog.Infof("Finding client version...")
-	ver.client, err = binver.Client(filepath.Join(release, "client"))
+	ver.client, err = binver.Client(context.Background(), filepath.Join(release, "client"))
 	if err != nil {
 		return nil, fmt.Errorf("error reading client version: %v", err)
 	}
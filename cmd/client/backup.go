@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prattmic/restic-remote/api"
+	"github.com/prattmic/restic-remote/event"
+	"github.com/prattmic/restic-remote/log"
+	"github.com/prattmic/restic-remote/restic"
+	"github.com/spf13/viper"
+)
+
+// runBackup implements the backup command. It checks for updates, then backs
+// up each profile that is due.
+func runBackup(ctx context.Context, args []string) {
+	if len(args) > 0 {
+		log.Exitf("Unexpected arguments: %v", args)
+	}
+
+	log.Infof("restic-remote client started")
+
+	a, err := newAPI(ctx)
+	if err != nil {
+		log.Exitf("Failed to create API: %v", err)
+	}
+
+	start := time.Now()
+	err = acquireInstance(ctx, viper.GetString("instance-policy"), viper.GetDuration("instance-wait"))
+	if re, ok := err.(*runningError); ok {
+		log.Warningf("Skipping run: %v", re)
+		if err := a.BackupSkipped("", re.Error()); err != nil {
+			log.Warningf("Error writing BackupSkipped event: %v", err)
+		}
+		recordSkipped(start, re.Error())
+		flushEvents(a)
+		os.Exit(0)
+	} else if err != nil {
+		log.Exitf("Failed to acquire lock file: %v", err)
+	}
+	defer finish(a)
+
+	if err := a.ClientStarted(); err != nil {
+		log.Warningf("Error writing ClientStarted event: %v", err)
+	}
+
+	var conds conditions
+	if err := viper.UnmarshalKey("conditions", &conds); err != nil {
+		finish(a)
+		log.Exitf("Failed to load conditions: %v", err)
+	}
+	// Updates and backups may both transfer a lot of data, so skip both.
+	if reason := conds.check(); reason != "" {
+		log.Warningf("Skipping run: %s", reason)
+		if err := a.BackupSkipped("", reason); err != nil {
+			log.Warningf("Error writing BackupSkipped event: %v", err)
+		}
+		recordSkipped(start, reason)
+		return
+	}
+
+	if err := updateCheck(ctx, a); err != nil {
+		log.Errorf("Unable to update: %v", err)
+	}
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		finish(a)
+		log.Exitf("Failed to load profiles: %v", err)
+	}
+
+	st, err := readState()
+	if err != nil {
+		log.Warningf("Unable to read state, backing up all profiles: %v", err)
+	}
+
+	failed := 0
+	for i := range profiles {
+		p := &profiles[i]
+
+		if ctx.Err() != nil {
+			log.Warningf("Not backing up profile %q: %v", p.Name, ctx.Err())
+			failed++
+			continue
+		}
+
+		last := st.LastBackup[p.Name]
+		if !p.due(last) {
+			log.Infof("Skipping profile %q, last backed up at %v", p.Name, last)
+			continue
+		}
+
+		h := historyEntry{
+			Profile: p.Name,
+			Start:   time.Now(),
+		}
+		err := backupProfile(ctx, a, p, &h)
+		h.End = time.Now()
+		h.Result = resultSucceeded
+		if err != nil {
+			h.Result = resultFailed
+			h.Error = err.Error()
+		}
+		if err := recordHistory(&h); err != nil {
+			log.Warningf("Unable to record history: %v", err)
+		}
+
+		if err != nil {
+			log.Errorf("Failed to back up profile %q: %v", p.Name, err)
+			failed++
+			continue
+		}
+
+		st.LastBackup[p.Name] = time.Now()
+		if err := st.write(); err != nil {
+			log.Warningf("Unable to write state: %v", err)
+		}
+	}
+
+	if failed > 0 {
+		finish(a)
+		log.Exitf("%d of %d profiles failed to back up", failed, len(profiles))
+	}
+}
+
+// flushEvents sends any events queued by a.
+func flushEvents(a *api.API) {
+	if err := a.Flush(); err != nil {
+		log.Warningf("Error flushing events: %v", err)
+	}
+}
+
+// finish sends any events queued by a, and releases the process lock file.
+// It must be called before exiting once the lock file is held.
+func finish(a *api.API) {
+	flushEvents(a)
+	releaseInstance()
+}
+
+// backupProfile backs up p, running its hooks around the backup. On success,
+// it forgets old snapshots according to the retention policy.
+//
+// The paths and each stdin source are backed up separately, and all are
+// attempted even if one fails. The snapshots created and their summaries are
+// recorded in h.
+func backupProfile(ctx context.Context, a *api.API, p *profile, h *historyEntry) error {
+	if len(p.Backup) < 1 && len(p.Stdin) < 1 {
+		reportFailure(a, p, event.CauseConfig, 0, "nothing to back up")
+		return fmt.Errorf("nothing to back up")
+	}
+
+	r, err := newRestic(p.Restic)
+	if err != nil {
+		reportFailure(a, p, event.CauseConfig, 0, err.Error())
+		return fmt.Errorf("failed to create restic: %v", err)
+	}
+
+	if p.Restic.AutoInit {
+		if err := ensureRepository(ctx, a, r, p); err != nil {
+			return err
+		}
+	}
+
+	if err := removeStaleLocks(ctx, a, r, p); err != nil {
+		log.Warningf("Unable to remove stale locks: %v", err)
+	}
+
+	run := &hookRun{profile: p.Name}
+
+	err = runHooks(ctx, a, p.Hooks.Pre, "pre", run, true)
+	if err == nil {
+		if len(p.Backup) > 0 {
+			err = backupPaths(ctx, a, r, p, run)
+		}
+		for i := range p.Stdin {
+			if serr := backupStdin(ctx, a, r, p, &p.Stdin[i], run); serr != nil && err == nil {
+				err = serr
+			}
+		}
+	} else {
+		log.Errorf("Aborting backup of profile %q: %v", p.Name, err)
+
+		run.exitStatus = -1
+		reportFailure(a, p, event.CauseHook, 0, fmt.Sprintf("backup aborted: %v", err))
+	}
+	run.done = true
+	run.succeeded = err == nil
+	h.SnapshotIDs = run.snapshotIDs
+	h.Summary = run.summaries
+
+	// Post hooks may need to undo the pre hooks, so run them even if ctx
+	// has been cancelled. They are still limited by their timeouts.
+	hctx := context.Background()
+	if herr := runHooks(hctx, a, p.Hooks.Post, "post", run, false); herr != nil {
+		log.Warningf("Post-backup hooks failed: %v", herr)
+	}
+	if err != nil {
+		if herr := runHooks(hctx, a, p.Hooks.OnFailure, "on-failure", run, false); herr != nil {
+			log.Warningf("On-failure hooks failed: %v", herr)
+		}
+		return err
+	}
+
+	if !p.Retention.Empty() {
+		forget(ctx, a, r, p)
+	}
+
+	return nil
+}
+
+// ensureRepository initializes the repository of p if it does not exist.
+// Failures are reported to a.
+func ensureRepository(ctx context.Context, a *api.API, r *restic.Restic, p *profile) error {
+	exists, err := r.RepositoryExists(ctx)
+	if err != nil {
+		// Don't risk initializing over a repository we just can't
+		// reach.
+		cause := string(restic.ClassOf(err))
+		err = fmt.Errorf("unable to determine whether repository exists: %v", err)
+		reportFailure(a, p, cause, 0, err.Error())
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	log.Infof("Initializing repository for profile %q", p.Name)
+
+	so, err := r.Init(ctx)
+	if err != nil {
+		reportFailure(a, p, string(restic.ClassOf(err)), 0, err.Error())
+		return fmt.Errorf("failed to initialize repository: %v", err)
+	}
+
+	if err := a.RepositoryInitialized(p.Name, so); err != nil {
+		log.Warningf("Error writing RepositoryInitialized event: %v", err)
+	}
+
+	return nil
+}
+
+// reportFailure writes a BackupFailed or BackupTimedOut event for a failure
+// with the given cause, after the given number of backup attempts.
+func reportFailure(a *api.API, p *profile, cause string, attempts int, message string) {
+	if cause == event.CauseTimeout {
+		if err := a.BackupTimedOut(p.Name, attempts, message); err != nil {
+			log.Warningf("Error writing BackupTimedOut event: %v", err)
+		}
+		return
+	}
+
+	if err := a.BackupFailed(p.Name, cause, attempts, message); err != nil {
+		log.Warningf("Error writing BackupFailed event: %v", err)
+	}
+}
+
+// recordFailure records the restic exit status of err in run.
+func recordFailure(run *hookRun, err error) {
+	run.exitStatus = -1
+	if e, ok := err.(*restic.Error); ok {
+		run.exitStatus = e.Status
+	}
+}
+
+// attemptBackup calls attempt, retrying according to the retry policy of p,
+// and reports the final result to a. On success, sum is the summary of the
+// successful attempt.
+func attemptBackup(ctx context.Context, a *api.API, p *profile, sum *event.BackupSummary, attempt attemptFunc) error {
+	attempts, cause, message, err := p.Retry.retry(ctx, a, p.Name, attempt)
+	if err != nil {
+		reportFailure(a, p, cause, attempts, message)
+		return err
+	}
+
+	if err := a.BackupSucceeded(p.Name, attempts, sum, message); err != nil {
+		log.Warningf("Error writing BackupSucceeded event: %v", err)
+	}
+
+	return nil
+}
+
+// backupPaths backs up the paths of p, recording the result in run.
+func backupPaths(ctx context.Context, a *api.API, r *restic.Restic, p *profile, run *hookRun) error {
+	log.Infof("Backing up profile %q: %+v", p.Name, p.Backup)
+
+	if err := a.BackupStarted(p.Name, p.Backup); err != nil {
+		log.Warningf("Error writing BackupStarted event: %v", err)
+	}
+
+	progress := newProgress(a, p.Name)
+	var sum event.BackupSummary
+	return attemptBackup(ctx, a, p, &sum, func() (string, string, error) {
+		so, se, err := r.Backup(ctx, p.Backup, progress)
+		if id := restic.SnapshotID(so); id != "" {
+			run.snapshotIDs = append(run.snapshotIDs, id)
+		}
+		if s := restic.Summary(so); s != "" {
+			run.summaries = append(run.summaries, s)
+		}
+		sum = backupSummary(so)
+		message := fmt.Sprintf("stdout:\n%s\nstderr:\n%s", so, se)
+		log.Infof("restic backup: %s\n", message)
+		if err != nil {
+			recordFailure(run, err)
+			return string(restic.ClassOf(err)), message, fmt.Errorf("failed to backup: %v", err)
+		}
+		return "", message, nil
+	})
+}
+
+// backupStdin backs up the output of src, recording the result in run.
+func backupStdin(ctx context.Context, a *api.API, r *restic.Restic, p *profile, src *stdinSource, run *hookRun) error {
+	desc := fmt.Sprintf("stdin:%s from %q", src.Filename, src.Command)
+	log.Infof("Backing up profile %q: %s", p.Name, desc)
+
+	if err := a.BackupStarted(p.Name, []string{desc}); err != nil {
+		log.Warningf("Error writing BackupStarted event: %v", err)
+	}
+
+	progress := newProgress(a, p.Name)
+	var sum event.BackupSummary
+	return attemptBackup(ctx, a, p, &sum, func() (string, string, error) {
+		cause, message, err := backupStdinOnce(ctx, r, src, run, progress, &sum)
+		if err != nil {
+			log.Errorf("Failed to back up %s: %v; %s", desc, err, message)
+			return cause, fmt.Sprintf("%s: %v\n%s", desc, err, message), fmt.Errorf("failed to back up %s: %v", desc, err)
+		}
+		return "", message, nil
+	})
+}
+
+// backupStdinOnce makes a single attempt to back up the output of src,
+// recording the result in run and sum. Progress is reported to progress, if
+// non-nil.
+//
+// If the command fails, the snapshot may be incomplete, so it is removed.
+func backupStdinOnce(ctx context.Context, r *restic.Restic, src *stdinSource, run *hookRun, progress restic.ProgressFunc, sum *event.BackupSummary) (string, string, error) {
+	c := shellCommand(ctx, src.Command)
+	var ce bytes.Buffer
+	c.Stderr = &ce
+	out, err := c.StdoutPipe()
+	if err != nil {
+		run.exitStatus = -1
+		return event.CauseCommand, "", fmt.Errorf("error creating pipe: %v", err)
+	}
+	if err := c.Start(); err != nil {
+		run.exitStatus = -1
+		return event.CauseCommand, "", fmt.Errorf("error starting command: %v", err)
+	}
+
+	so, se, rerr := r.BackupStdin(ctx, src.Filename, out, progress)
+	// If restic exited early, unblock the command.
+	out.Close()
+	cerr := c.Wait()
+
+	id := restic.SnapshotID(so)
+	message := fmt.Sprintf("stdout:\n%s\nstderr:\n%s\ncommand stderr:\n%s", so, se, ce.String())
+	log.Infof("restic backup: %s\n", message)
+
+	if rerr != nil {
+		recordFailure(run, rerr)
+		return string(restic.ClassOf(rerr)), message, rerr
+	}
+
+	if cerr != nil {
+		run.exitStatus = -1
+		if id != "" {
+			log.Warningf("Removing incomplete snapshot %s", id)
+			if err := r.ForgetSnapshot(ctx, id); err != nil {
+				log.Errorf("Failed to remove incomplete snapshot %s: %v", id, err)
+				run.snapshotIDs = append(run.snapshotIDs, id)
+			}
+		}
+		return event.CauseCommand, message, fmt.Errorf("command failed: %v", cerr)
+	}
+
+	if id != "" {
+		run.snapshotIDs = append(run.snapshotIDs, id)
+	}
+	if s := restic.Summary(so); s != "" {
+		run.summaries = append(run.summaries, s)
+	}
+	*sum = backupSummary(so)
+
+	return "", message, nil
+}
+
+// backupSummary returns the event summary of a 'restic backup', given its
+// stdout.
+func backupSummary(stdout string) event.BackupSummary {
+	sum := event.BackupSummary{
+		SnapshotID: restic.SnapshotID(stdout),
+	}
+	if st, ok := restic.BackupStats(stdout); ok {
+		sum.FilesNew = int64(st.FilesNew)
+		sum.FilesChanged = int64(st.FilesChanged)
+		sum.TotalFiles = int64(st.TotalFiles)
+		sum.TotalBytes = int64(st.TotalBytes)
+		sum.DataAdded = int64(st.DataAdded)
+		sum.Duration = st.Duration
+	}
+	return sum
+}
+
+// forget forgets old snapshots of p according to its retention policy.
+//
+// The backup itself already succeeded, so failures are only reported.
+func forget(ctx context.Context, a *api.API, r *restic.Restic, p *profile) {
+	log.Infof("Forgetting snapshots of profile %q with policy %+v", p.Name, p.Retention)
+
+	so, err := r.Forget(ctx, p.Retention)
+	if err != nil {
+		log.Errorf("Failed to forget snapshots: %v", err)
+		if err := a.ForgetFailed(p.Name, err.Error()); err != nil {
+			log.Warningf("Error writing ForgetFailed event: %v", err)
+		}
+		return
+	}
+
+	if err := a.ForgetSucceeded(p.Name, so); err != nil {
+		log.Warningf("Error writing ForgetSucceeded event: %v", err)
+	}
+}
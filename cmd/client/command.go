@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// defaultCommand is run if no command is given, so that existing scheduled
+// tasks keep working.
+const defaultCommand = "backup"
+
+// command is a client subcommand.
+type command struct {
+	// name is the command name.
+	name string
+
+	// usage describes the command arguments.
+	usage string
+
+	// desc is a short description of the command.
+	desc string
+
+	// flags are the command's flags. The global flags are added before
+	// parsing.
+	flags *pflag.FlagSet
+
+	// run runs the command with the non-flag arguments.
+	run func(ctx context.Context, args []string)
+}
+
+// Flag sets for each command. Flags are defined in config.go or alongside the
+// command.
+var (
+	backupFlags    = newFlagSet("backup")
+	updateFlags    = newFlagSet("update")
+	snapshotsFlags = newFlagSet("snapshots")
+	restoreFlags   = newFlagSet("restore")
+	checkFlags     = newFlagSet("check")
+	statusFlags    = newFlagSet("status")
+	historyFlags   = newFlagSet("history")
+	configFlags    = newFlagSet("config")
+	resticFlags    = newFlagSet("restic")
+	setupFlags     = newFlagSet("setup")
+)
+
+// commands are the available commands, by name.
+var commands map[string]*command
+
+func init() {
+	cs := []*command{
+		{"backup", "", "Back up all due profiles (default)", backupFlags, runBackup},
+		{"update", "", "Check for and install updates", updateFlags, runUpdate},
+		{"snapshots", "", "List snapshots of this host", snapshotsFlags, runSnapshots},
+		{"restore", "[SNAPSHOT]", "Restore a snapshot (default latest)", restoreFlags, runRestore},
+		{"check", "", "Check repositories for errors", checkFlags, runCheck},
+		{"status", "", "Show the backup status of each profile", statusFlags, runStatus},
+		{"history", "", "Show recent backup runs", historyFlags, runHistory},
+		{"config", "validate", "Validate the configuration", configFlags, runConfig},
+		{"restic", "-- [ARGS...]", "Run restic with the configured repository", resticFlags, runRestic},
+		{"setup", "", "Configure and enroll this machine", setupFlags, runSetup},
+	}
+
+	commands = make(map[string]*command)
+	for _, c := range cs {
+		commands[c.name] = c
+	}
+
+	// The restic command passes everything after the first argument
+	// through to restic.
+	resticFlags.SetInterspersed(false)
+
+	pflag.Usage = usage
+}
+
+// newFlagSet returns a new flag set for command name.
+func newFlagSet(name string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ExitOnError)
+	fs.Usage = func() {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n\n%s.\n\nFlags:\n", os.Args[0], name, c.usage, c.desc)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// usage prints the top-level usage.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [COMMAND] [command flags] [ARGS...]\n\nCommands:\n", os.Args[0])
+
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", n, commands[n].desc)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nGlobal flags:\n")
+	pflag.PrintDefaults()
+}
+
+// splitCommand finds the command in args, which may be preceded by global
+// flags. It returns the command name and the remaining arguments.
+//
+// If there is no command, or args contain flags that are not global flags
+// before any command, the default command is used with all of args.
+func splitCommand(global *pflag.FlagSet, args []string) (string, []string) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+
+		if a == "-h" || a == "--help" || a == "help" {
+			return "help", nil
+		}
+
+		// --restic is the old form of the restic command.
+		if a == "--restic" {
+			return "restic", append(args[:i:i], args[i+1:]...)
+		}
+
+		if a == "--" || a == "-" || !strings.HasPrefix(a, "-") {
+			if _, ok := commands[a]; ok {
+				return a, append(args[:i:i], args[i+1:]...)
+			}
+			return defaultCommand, args
+		}
+
+		name := strings.TrimLeft(a, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		f := global.Lookup(name)
+		if f == nil {
+			// Probably a default command flag.
+			return defaultCommand, args
+		}
+		if f.NoOptDefVal == "" {
+			// Skip the flag value.
+			i++
+		}
+	}
+
+	return defaultCommand, args
+}
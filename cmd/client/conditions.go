@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultProbeTimeout is the default timeout for reachable-host probes.
+const defaultProbeTimeout = 5 * time.Second
+
+// conditions are the network and power conditions required to run backups.
+//
+// Unset conditions are not checked.
+type conditions struct {
+	// Interfaces requires at least one of these network interfaces to be
+	// up with an address.
+	Interfaces []string
+
+	// SSIDs requires the connected wireless network to be one of these.
+	SSIDs []string `mapstructure:"ssids"`
+
+	// Reachable requires each of these host:port addresses to accept TCP
+	// connections.
+	Reachable []string
+
+	// ProbeTimeout is the timeout for each Reachable probe. 0 uses
+	// defaultProbeTimeout.
+	ProbeTimeout time.Duration `mapstructure:"probe-timeout"`
+
+	// SkipMetered skips backups if the active network connection is
+	// metered.
+	SkipMetered bool `mapstructure:"skip-metered"`
+
+	// ACPower requires the machine to be on AC power.
+	ACPower bool `mapstructure:"ac-power"`
+}
+
+// check returns a reason to skip backups if the conditions are not met, or
+// the empty string if backups may proceed.
+//
+// If a condition cannot be determined, backups are skipped.
+func (c *conditions) check() string {
+	if len(c.Interfaces) > 0 {
+		if err := interfaceUp(c.Interfaces); err != nil {
+			return err.Error()
+		}
+	}
+
+	if len(c.SSIDs) > 0 {
+		ssid, err := currentSSID()
+		if err != nil {
+			return fmt.Sprintf("unable to determine SSID: %v", err)
+		}
+		if !contains(c.SSIDs, ssid) {
+			return fmt.Sprintf("SSID %q not in allowed list %v", ssid, c.SSIDs)
+		}
+	}
+
+	timeout := c.ProbeTimeout
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+	for _, addr := range c.Reachable {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return fmt.Sprintf("host %s unreachable: %v", addr, err)
+		}
+		conn.Close()
+	}
+
+	if c.SkipMetered {
+		m, err := metered()
+		if err != nil {
+			return fmt.Sprintf("unable to determine whether network is metered: %v", err)
+		}
+		if m {
+			return "network connection is metered"
+		}
+	}
+
+	if c.ACPower {
+		ac, err := onACPower()
+		if err != nil {
+			return fmt.Sprintf("unable to determine power source: %v", err)
+		}
+		if !ac {
+			return "not on AC power"
+		}
+	}
+
+	return ""
+}
+
+// interfaceUp returns nil if any of the named interfaces is up and has an
+// address.
+func interfaceUp(names []string) error {
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err == nil && len(addrs) > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of interfaces %v are up", names)
+}
+
+// contains returns true if s is in l.
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
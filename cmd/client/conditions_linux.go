@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// powerSupplyDir contains the kernel's power supply class devices.
+const powerSupplyDir = "/sys/class/power_supply"
+
+// currentSSID returns the SSID of the active wireless connection, as reported
+// by NetworkManager.
+func currentSSID() (string, error) {
+	out, err := exec.Command("nmcli", "-t", "-f", "active,ssid", "device", "wifi").Output()
+	if err != nil {
+		return "", fmt.Errorf("nmcli failed: %v", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "yes:") {
+			// nmcli escapes : in terse output.
+			return strings.Replace(strings.TrimPrefix(line, "yes:"), `\:`, ":", -1), nil
+		}
+	}
+
+	return "", fmt.Errorf("no active wireless connection")
+}
+
+// metered returns true if any connected device is metered, as reported by
+// NetworkManager. Guessed values count.
+func metered() (bool, error) {
+	out, err := exec.Command("nmcli", "-t", "-f", "GENERAL.STATE,GENERAL.METERED", "device", "show").Output()
+	if err != nil {
+		return false, fmt.Errorf("nmcli failed: %v", err)
+	}
+
+	// Each device is a GENERAL.STATE line followed by a GENERAL.METERED
+	// line.
+	connected := false
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "GENERAL.STATE:"):
+			// 100 is NM_DEVICE_STATE_ACTIVATED.
+			connected = strings.HasPrefix(strings.TrimPrefix(line, "GENERAL.STATE:"), "100")
+		case strings.HasPrefix(line, "GENERAL.METERED:"):
+			if connected && strings.HasPrefix(strings.TrimPrefix(line, "GENERAL.METERED:"), "yes") {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// onACPower returns true if any mains power supply is online. Machines
+// without a mains power supply (e.g., most desktops) are considered on AC
+// power.
+func onACPower() (bool, error) {
+	supplies, err := ioutil.ReadDir(powerSupplyDir)
+	if err != nil {
+		return false, fmt.Errorf("error reading %s: %v", powerSupplyDir, err)
+	}
+
+	found := false
+	for _, s := range supplies {
+		dir := filepath.Join(powerSupplyDir, s.Name())
+		t, err := ioutil.ReadFile(filepath.Join(dir, "type"))
+		if err != nil || strings.TrimSpace(string(t)) != "Mains" {
+			continue
+		}
+		found = true
+
+		online, err := ioutil.ReadFile(filepath.Join(dir, "online"))
+		if err != nil {
+			return false, fmt.Errorf("error reading %s status: %v", s.Name(), err)
+		}
+		if strings.TrimSpace(string(online)) == "1" {
+			return true, nil
+		}
+	}
+
+	return !found, nil
+}
+
+// unsupportedConditions returns the keys of the conditions set in c that
+// cannot be detected. All conditions are supported on Linux.
+func unsupportedConditions(c *conditions) []string {
+	return nil
+}
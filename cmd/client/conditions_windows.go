@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+)
+
+// currentSSID is not supported on Windows.
+func currentSSID() (string, error) {
+	return "", fmt.Errorf("SSID detection not supported on Windows")
+}
+
+// metered is not supported on Windows.
+func metered() (bool, error) {
+	return false, fmt.Errorf("metered network detection not supported on Windows")
+}
+
+// onACPower is not supported on Windows.
+func onACPower() (bool, error) {
+	return false, fmt.Errorf("power source detection not supported on Windows")
+}
+
+// unsupportedConditions returns the keys of the conditions set in c that
+// cannot be detected on Windows.
+func unsupportedConditions(c *conditions) []string {
+	var keys []string
+	if len(c.SSIDs) > 0 {
+		keys = append(keys, "ssids")
+	}
+	if c.SkipMetered {
+		keys = append(keys, "skip-metered")
+	}
+	if c.ACPower {
+		keys = append(keys, "ac-power")
+	}
+	return keys
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	"github.com/prattmic/restic-remote/api"
+	"github.com/prattmic/restic-remote/auth0"
 	"github.com/prattmic/restic-remote/config"
 	"github.com/prattmic/restic-remote/log"
 	"github.com/prattmic/restic-remote/restic"
@@ -13,66 +15,117 @@ import (
 	"github.com/spf13/viper"
 )
 
-// boundStringFlag defines a new flag that is bound to a viper key.
+// boundStringFlag defines a new flag in fs that is bound to a viper key.
 //
 // name is the viper key name. The flag name replaces . with -.
-func boundStringFlag(name, d, desc string) {
+func boundStringFlag(fs *pflag.FlagSet, name, d, desc string) {
 	fname := strings.Replace(name, ".", "-", -1)
-	pflag.String(fname, d, desc)
-	viper.BindPFlag(name, pflag.Lookup(fname))
+	fs.String(fname, d, desc)
+	viper.BindPFlag(name, fs.Lookup(fname))
 }
 
 // boundStringSliceFlag is equivalent to boundStringFlag for StringSlice flags.
-func boundStringSliceFlag(name string, d []string, desc string) {
+func boundStringSliceFlag(fs *pflag.FlagSet, name string, d []string, desc string) {
 	fname := strings.Replace(name, ".", "-", -1)
-	pflag.StringSlice(fname, d, desc)
-	viper.BindPFlag(name, pflag.Lookup(fname))
+	fs.StringSlice(fname, d, desc)
+	viper.BindPFlag(name, fs.Lookup(fname))
+}
+
+// boundUint64Flag is equivalent to boundStringFlag for uint64 flags.
+func boundUint64Flag(fs *pflag.FlagSet, name string, d uint64, desc string) {
+	fname := strings.Replace(name, ".", "-", -1)
+	fs.Uint64(fname, d, desc)
+	viper.BindPFlag(name, fs.Lookup(fname))
+}
+
+// boundIntFlag is equivalent to boundStringFlag for int flags.
+func boundIntFlag(fs *pflag.FlagSet, name string, d int, desc string) {
+	fname := strings.Replace(name, ".", "-", -1)
+	fs.Int(fname, d, desc)
+	viper.BindPFlag(name, fs.Lookup(fname))
 }
 
 // boundBoolFlag is equivalent to boundStringFlag for bool flags.
-func boundBoolFlag(name string, d bool, desc string) {
+func boundBoolFlag(fs *pflag.FlagSet, name string, d bool, desc string) {
 	fname := strings.Replace(name, ".", "-", -1)
-	pflag.Bool(fname, d, desc)
-	viper.BindPFlag(name, pflag.Lookup(fname))
+	fs.Bool(fname, d, desc)
+	viper.BindPFlag(name, fs.Lookup(fname))
 }
 
 func init() {
+	// Global flags, shared by all commands.
+	g := pflag.CommandLine
+
 	// viper top-level options.
-	boundStringSliceFlag("backup", nil, "list of paths to backup")
-	boundStringFlag("hostname", "", "hostname to use for api and snapshots")
-	boundBoolFlag("update", true, "perform an update check")
+	boundStringFlag(g, "hostname", "", "hostname to use for api and snapshots")
+
+	// backup command options.
+	boundStringSliceFlag(backupFlags, "backup", nil, "list of paths to backup, if no profiles are configured")
+	boundBoolFlag(backupFlags, "update", true, "perform an update check")
+	boundStringFlag(backupFlags, "instance-policy", policySkip, "what to do if another client is running (skip, wait, or kill-older)")
+	boundStringFlag(backupFlags, "instance-wait", "1h", "maximum time to wait for another client with --instance-policy=wait")
+	boundStringFlag(backupFlags, "stale-lock-age", "1h", "minimum age of stale repository locks from this machine to remove (0 to disable)")
+	boundStringFlag(backupFlags, "progress-interval", "0", "minimum interval between backup progress reports (0 to disable; requires restic 0.9.5+)")
 
 	// viper "api" sub-tree.
-	boundStringFlag("api.root", "", "API root URL")
-	boundStringFlag("api.client-id", "", "API client ID")
-	boundStringFlag("api.client-secret", "", "API client secret")
-	boundStringFlag("api.audience", "", "API audience name")
-	boundStringFlag("api.token-url", "", "API token URL")
+	boundStringFlag(g, "api.root", "", "API root URL")
+	boundStringFlag(g, "api.provider", auth0.ProviderAuth0, "API authentication provider (auth0, oidc, static, or mtls)")
+	boundStringFlag(g, "api.client-id", "", "API client ID")
+	boundStringFlag(g, "api.client-secret", "", "API client secret or secret reference (file:, env:, cmd:, secret-service:)")
+	boundStringFlag(g, "api.audience", "", "API audience name")
+	boundStringFlag(g, "api.token-url", "", "API token URL")
+	boundStringSliceFlag(g, "api.scopes", nil, "scopes to request from the OIDC provider")
+	boundStringFlag(g, "api.token", "", "API static bearer token or secret reference (file:, env:, cmd:, secret-service:)")
+	boundStringFlag(g, "api.cert-file", "", "API mTLS client certificate path")
+	boundStringFlag(g, "api.key-file", "", "API mTLS client key path")
+	boundStringFlag(g, "api.ca-file", "", "API mTLS server CA bundle path")
+	boundStringFlag(g, "api.timeout", "30s", "deadline for each API request attempt")
+	boundIntFlag(g, "api.max-attempts", 3, "maximum attempts of each API request, for network errors and server errors")
+	boundStringFlag(g, "api.batch-delay", "5s", "how long to queue events before sending them in a batch (0 to send immediately)")
+	boundIntFlag(g, "api.breaker-threshold", 5, "consecutive failed API requests after which the API is not used for the rest of the run (negative to disable)")
 
 	// viper "restic" sub-tree.
-	boundStringFlag("restic.binary", "", "restic binary path")
-	boundStringFlag("restic.repository", "", "restic repository path")
-	boundStringFlag("restic.password", "", "restic repository password")
-	boundStringFlag("restic.limit-download", "", "restic download bandwidth limit (KiB/s)")
-	boundStringFlag("restic.limit-upload", "", "restic upload bandwidth limit (KiB/s)")
-	boundStringFlag("restic.gcs-chunk-size", "", "GCS upload chunk size (bytes)")
+	boundStringFlag(g, "restic.binary", "", "restic binary path")
+	boundStringFlag(g, "restic.repository", "", "restic repository path")
+	boundStringFlag(g, "restic.password", "", "restic repository password or secret reference (file:, env:, cmd:, secret-service:)")
+	boundUint64Flag(g, "restic.limit-download", 0, "restic download bandwidth limit (KiB/s)")
+	boundUint64Flag(g, "restic.limit-upload", 0, "restic upload bandwidth limit (KiB/s)")
+	boundStringFlag(g, "restic.gcs-chunk-size", "", "GCS upload chunk size (bytes)")
+	boundBoolFlag(g, "restic.auto-init", false, "initialize the repository if it does not exist")
+	boundStringSliceFlag(g, "restic.exclude", nil, "patterns to exclude from backups")
+	boundStringSliceFlag(g, "restic.exclude-file", nil, "files containing patterns to exclude from backups")
+	boundBoolFlag(g, "restic.exclude-caches", false, "exclude directories containing a CACHEDIR.TAG file")
+	boundStringSliceFlag(g, "restic.exclude-if-present", nil, "exclude directories containing any of these files")
+	boundStringFlag(g, "restic.exclude-larger-than", "", "exclude files larger than this size (e.g., 500M)")
+	boundBoolFlag(g, "restic.one-file-system", false, "don't cross filesystem boundaries during backups")
 
 	// viper "google" sub-tree.
-	boundStringFlag("google.project-number", "", "Google Cloud project number for restic and update GCS operations")
-	boundStringFlag("google.credentials", "", "Google Cloud application credentials JSON path for restic and update GCS operation")
-	boundStringFlag("google.binary-bucket", "", "Bucket containing binary releases (just name, no gs://)")
+	boundStringFlag(g, "google.project-number", "", "Google Cloud project number for restic and update GCS operations")
+	boundStringFlag(g, "google.credentials", "", "Google Cloud application credentials JSON path for restic and update GCS operation")
+	boundStringFlag(g, "google.binary-bucket", "", "Bucket containing binary releases (just name, no gs://)")
 }
 
 // configFolderName is the application directory inside of the system config
 // dir when our configuration is stored.
 const configFolderName = "restic-remote"
 
+// configDir is the application config directory, or empty if it is unknown.
+// It is set by readConfig.
+var configDir string
+
+// configErr is the error reading the config file, if any. It is set by
+// readConfig.
+var configErr error
+
 // readConfig reads the global viper config.
-func readConfig() {
+//
+// If requireHostname is set, it exits if no hostname is configured.
+func readConfig(requireHostname bool) {
 	cd, err := config.Dir(configFolderName)
 	if err != nil {
 		log.Warningf("Unable to find config directory: %v", err)
 	} else {
+		configDir = cd
 		viper.AddConfigPath(cd)
 	}
 
@@ -82,13 +135,18 @@ func readConfig() {
 
 	if err := viper.ReadInConfig(); err != nil {
 		log.Warningf("Unable to read config: %v", err)
+		configErr = err
 	}
 
-	if viper.GetString("hostname") == "" {
+	if requireHostname && viper.GetString("hostname") == "" {
 		log.Exitf("hostname required")
 	}
 }
 
+// tokenCacheFile is the name of the API access token cache in the config
+// directory.
+const tokenCacheFile = "token.json"
+
 // newAPI creates an api.API from the viper config.
 func newAPI(ctx context.Context) (*api.API, error) {
 	var aconf api.Config
@@ -97,16 +155,32 @@ func newAPI(ctx context.Context) (*api.API, error) {
 	}
 	aconf.Hostname = viper.GetString("hostname")
 
+	secret, err := resolveSecret(aconf.ClientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving API client secret: %v", err)
+	}
+	aconf.ClientSecret = secret
+
+	token, err := resolveSecret(aconf.Token)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving API token: %v", err)
+	}
+	aconf.Token = token
+
+	if configDir != "" {
+		aconf.CacheFile = filepath.Join(configDir, tokenCacheFile)
+	}
+
 	return api.New(ctx, aconf)
 }
 
-// newRestic creates a restic.Restic from the viper config.
-func newRestic() (*restic.Restic, error) {
-	var rconf restic.Config
-	if err := viper.UnmarshalKey("restic", &rconf); err != nil {
-		return nil, fmt.Errorf("error unmarshalling restic config: %v", err)
-	}
+// newRestic creates a restic.Restic from rconf, filling in the remaining
+// settings from the viper config.
+func newRestic(rconf restic.Config) (*restic.Restic, error) {
 	rconf.Hostname = viper.GetString("hostname")
+	if err := resolvePassword(&rconf); err != nil {
+		return nil, err
+	}
 	rconf.BackendEnv = map[string]string{
 		"GOOGLE_PROJECT_ID":              viper.GetString("google.project-number"),
 		"GOOGLE_APPLICATION_CREDENTIALS": viper.GetString("google.credentials"),
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// historyFile is the name of the run history file in the config directory.
+const historyFile = "history.json"
+
+// maxHistory is the maximum number of history entries kept.
+const maxHistory = 500
+
+// Run results recorded in history.
+const (
+	resultSucceeded = "succeeded"
+	resultFailed    = "failed"
+	resultSkipped   = "skipped"
+)
+
+// historyEntry records a single backup run of a profile.
+type historyEntry struct {
+	// Profile is the profile backed up. It is empty for skipped runs that
+	// apply to all profiles.
+	Profile string
+
+	// Start and End are the times the run started and finished.
+	Start time.Time
+	End   time.Time
+
+	// Result is one of resultSucceeded, resultFailed, or resultSkipped.
+	Result string
+
+	// Summary is restic's summary of each backup.
+	Summary []string `json:",omitempty"`
+
+	// SnapshotIDs are the IDs of the snapshots created.
+	SnapshotIDs []string `json:",omitempty"`
+
+	// Error describes why the run failed or was skipped.
+	Error string `json:",omitempty"`
+}
+
+// historyPath returns the path to the history file.
+func historyPath() (string, error) {
+	if configDir == "" {
+		return "", fmt.Errorf("config directory unknown")
+	}
+	return filepath.Join(configDir, historyFile), nil
+}
+
+// readHistory reads the run history, oldest first. A missing history file
+// results in empty history.
+func readHistory() ([]historyEntry, error) {
+	p, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading history: %v", err)
+	}
+
+	var h []historyEntry
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("error decoding history: %v", err)
+	}
+
+	return h, nil
+}
+
+// recordHistory appends e to the run history, dropping the oldest entries
+// beyond maxHistory.
+func recordHistory(e *historyEntry) error {
+	h, err := readHistory()
+	if err != nil {
+		// Don't let a corrupt history file prevent recording new
+		// runs.
+		h = nil
+	}
+
+	h = append(h, *e)
+	if len(h) > maxHistory {
+		h = h[len(h)-maxHistory:]
+	}
+
+	b, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding history: %v", err)
+	}
+
+	p, err := historyPath()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prattmic/restic-remote/api"
+	"github.com/prattmic/restic-remote/log"
+	"github.com/spf13/viper"
+)
+
+// defaultHookTimeout is the hook timeout used if none is configured.
+const defaultHookTimeout = 10 * time.Minute
+
+// hookWaitDelay is how long to wait for a timed out hook's output to close
+// after it is killed. Processes that escaped the hook's process group may
+// keep it open indefinitely.
+const hookWaitDelay = 10 * time.Second
+
+// hook is a command run around a backup.
+type hook struct {
+	// Command is the command to run. It is run by the system shell.
+	Command string
+
+	// Timeout is the maximum time the command may run. 0 uses
+	// defaultHookTimeout.
+	Timeout time.Duration
+
+	// AbortOnFailure skips the backup if this pre-backup hook fails. It is
+	// ignored for other hooks.
+	AbortOnFailure bool `mapstructure:"abort-on-failure"`
+}
+
+// hooks are the commands run around a backup of a profile.
+type hooks struct {
+	// Pre hooks run before the backup.
+	Pre []hook
+
+	// Post hooks run after the backup, whether or not it succeeded.
+	Post []hook
+
+	// OnFailure hooks run after the post hooks if the backup failed.
+	OnFailure []hook `mapstructure:"on-failure"`
+}
+
+// hookRun describes the backup run, which is passed to hooks as environment
+// variables.
+type hookRun struct {
+	// profile is the name of the profile being backed up.
+	profile string
+
+	// done indicates that the backup has completed (or been aborted). The
+	// fields below are only valid if done is set.
+	done bool
+
+	// succeeded indicates that the backup succeeded.
+	succeeded bool
+
+	// snapshotIDs are the IDs of the new snapshots, if any.
+	snapshotIDs []string
+
+	// summaries are restic's summaries of each completed backup. They are
+	// not passed to hooks.
+	summaries []string
+
+	// exitStatus is the exit status of the last failed restic command, or
+	// -1 if restic did not exit normally.
+	exitStatus int
+}
+
+// env returns the hook environment for stage (pre, post, or on-failure).
+func (r *hookRun) env(stage string) []string {
+	envv := os.Environ()
+	envv = append(envv, "RESTIC_REMOTE_HOOK="+stage)
+	envv = append(envv, "RESTIC_REMOTE_PROFILE="+r.profile)
+	envv = append(envv, "RESTIC_REMOTE_HOSTNAME="+viper.GetString("hostname"))
+	if r.done {
+		result := "failure"
+		if r.succeeded {
+			result = "success"
+		}
+		envv = append(envv, "RESTIC_REMOTE_RESULT="+result)
+		envv = append(envv, "RESTIC_REMOTE_SNAPSHOT_ID="+strings.Join(r.snapshotIDs, " "))
+		envv = append(envv, "RESTIC_REMOTE_EXIT_STATUS="+strconv.Itoa(r.exitStatus))
+	}
+	return envv
+}
+
+// runHook runs h, returning its combined stdout and stderr.
+func runHook(ctx context.Context, h *hook, envv []string) (string, error) {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c := hookCommand(ctx, h.Command)
+	c.Env = envv
+	c.WaitDelay = hookWaitDelay
+
+	b, err := c.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return string(b), fmt.Errorf("timed out after %v", timeout)
+	}
+	return string(b), err
+}
+
+// runHooks runs each of hs for stage, reporting the results to a.
+//
+// It returns the error from the first failed hook, after running all of
+// them. If abort is set, failures of hooks without AbortOnFailure are only
+// reported, and it returns immediately after the first hook that fails and
+// has AbortOnFailure set.
+func runHooks(ctx context.Context, a *api.API, hs []hook, stage string, run *hookRun, abort bool) error {
+	var first error
+	for i := range hs {
+		h := &hs[i]
+
+		log.Infof("Running %s hook for profile %q: %s", stage, run.profile, h.Command)
+
+		out, err := runHook(ctx, h, run.env(stage))
+		if err != nil {
+			log.Errorf("%s hook %q failed: %v; output: %s", stage, h.Command, err, out)
+
+			message := fmt.Sprintf("%s hook %q failed: %v\noutput:\n%s", stage, h.Command, err, out)
+			if err := a.HookFailed(run.profile, message); err != nil {
+				log.Warningf("Error writing HookFailed event: %v", err)
+			}
+
+			err = fmt.Errorf("%s hook %q failed: %v", stage, h.Command, err)
+			if abort {
+				if h.AbortOnFailure {
+					return err
+				}
+				continue
+			}
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+
+		log.Infof("%s hook %q succeeded; output: %s", stage, h.Command, out)
+
+		message := fmt.Sprintf("%s hook %q succeeded\noutput:\n%s", stage, h.Command, out)
+		if err := a.HookSucceeded(run.profile, message); err != nil {
+			log.Warningf("Error writing HookSucceeded event: %v", err)
+		}
+	}
+	return first
+}
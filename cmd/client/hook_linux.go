@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns a Cmd that runs command with the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+// hookCommand returns a Cmd that runs command with the system shell in a new
+// process group. When ctx is done, the whole group is killed, including any
+// processes the command started.
+func hookCommand(ctx context.Context, command string) *exec.Cmd {
+	c := shellCommand(ctx, command)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	return c
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// shellCommand returns a Cmd that runs command with the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd.exe", "/C", command)
+}
+
+// hookCommand returns a Cmd that runs command with the system shell.
+//
+// Processes started by the command are not killed with it; the caller's
+// WaitDelay bounds how long they can hold its output open.
+func hookCommand(ctx context.Context, command string) *exec.Cmd {
+	return shellCommand(ctx, command)
+}
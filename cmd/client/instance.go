@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prattmic/restic-remote/log"
+)
+
+// instanceFile is the name of the process lock file in the config directory.
+const instanceFile = "client.lock"
+
+// Policies for handling another running client, selected by the
+// "instance-policy" config.
+const (
+	// policySkip skips this run.
+	policySkip = "skip"
+
+	// policyWait waits for the other client to exit, for up to the
+	// "instance-wait" config, and skips this run if it does not.
+	policyWait = "wait"
+
+	// policyKillOlder terminates the other client.
+	policyKillOlder = "kill-older"
+)
+
+const (
+	// instancePollInterval is how often to check whether another client
+	// has exited.
+	instancePollInterval = 10 * time.Second
+
+	// killGrace is how long a terminated client has to exit before it is
+	// killed. It is longer than restic.interruptGrace so the other client
+	// has a chance to interrupt restic cleanly.
+	killGrace = 2 * time.Minute
+)
+
+// instance describes the client process holding the lock file.
+type instance struct {
+	// PID is the process ID of the client.
+	PID int
+
+	// Started is the time the client acquired the lock.
+	Started time.Time
+}
+
+// runningError is returned by acquireInstance when another client is
+// running.
+type runningError struct {
+	// holder is the running client.
+	holder instance
+}
+
+// Error implements error.Error.
+func (e *runningError) Error() string {
+	return fmt.Sprintf("another client (pid %d) has been running since %v", e.holder.PID, e.holder.Started)
+}
+
+// instancePath returns the path to the process lock file.
+func instancePath() (string, error) {
+	if configDir == "" {
+		return "", fmt.Errorf("config directory unknown")
+	}
+	return filepath.Join(configDir, instanceFile), nil
+}
+
+// tryAcquire attempts to create the lock file at path. If it already exists,
+// it returns the current holder, which is nil if the file was removed in the
+// meantime.
+func tryAcquire(path string) (bool, *instance, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		defer f.Close()
+
+		self := instance{
+			PID:     os.Getpid(),
+			Started: time.Now(),
+		}
+		if err := json.NewEncoder(f).Encode(&self); err != nil {
+			os.Remove(path)
+			return false, nil, fmt.Errorf("error writing lock file: %v", err)
+		}
+		return true, nil, nil
+	} else if !os.IsExist(err) {
+		return false, nil, fmt.Errorf("error creating lock file: %v", err)
+	}
+
+	holder, err := readInstance(path)
+	return false, holder, err
+}
+
+// readInstance reads the lock file at path. It returns nil if the file does
+// not exist, and an empty instance if it is malformed.
+func readInstance(path string) (*instance, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading lock file: %v", err)
+	}
+
+	var holder instance
+	if err := json.Unmarshal(b, &holder); err != nil {
+		// The holder may not have finished writing the file.
+		log.Warningf("Malformed lock file %q: %v", string(b), err)
+		return &instance{}, nil
+	}
+
+	return &holder, nil
+}
+
+// removeStale removes the lock file at path if it is still held by holder,
+// which is no longer running.
+func removeStale(path string, holder *instance) error {
+	log.Warningf("Removing stale lock file held by %+v", holder)
+
+	// Make sure another client didn't already replace the file.
+	current, err := readInstance(path)
+	if err != nil {
+		return err
+	}
+	if current == nil || *current != *holder {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing stale lock file: %v", err)
+	}
+	return nil
+}
+
+// startSlack allows for the limited precision of process start times.
+const startSlack = 2 * time.Second
+
+// processRunningSince returns true if the process with the given PID is
+// running and started no later than t.
+//
+// PIDs are reused, e.g., after a reboot, so a process with the same PID that
+// started after t is a different process.
+func processRunningSince(pid int, t time.Time) bool {
+	if !processExists(pid) {
+		return false
+	}
+
+	started, err := processStartTime(pid)
+	if err != nil {
+		// Err on the side of not disturbing a running process.
+		log.Warningf("Unable to get start time of pid %d: %v", pid, err)
+		return true
+	}
+	return !started.After(t.Add(startSlack))
+}
+
+// killInstance terminates holder, killing it if it does not exit within
+// killGrace.
+func killInstance(ctx context.Context, holder *instance) error {
+	log.Warningf("Terminating older client %+v", holder)
+	if err := terminateProcess(holder.PID); err != nil {
+		return fmt.Errorf("error terminating pid %d: %v", holder.PID, err)
+	}
+
+	deadline := time.Now().Add(killGrace)
+	for processExists(holder.PID) {
+		if time.Now().After(deadline) {
+			log.Warningf("Older client did not exit, killing")
+			if err := killProcess(holder.PID); err != nil {
+				return fmt.Errorf("error killing pid %d: %v", holder.PID, err)
+			}
+			deadline = time.Now().Add(killGrace)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	return nil
+}
+
+// heldInstance is the path of the lock file held by this client, or empty
+// if none is held.
+var heldInstance string
+
+// releaseInstance releases the process lock file, if held.
+func releaseInstance() {
+	if heldInstance == "" {
+		return
+	}
+	if err := os.Remove(heldInstance); err != nil {
+		log.Warningf("Unable to remove lock file: %v", err)
+	}
+	heldInstance = ""
+}
+
+// acquireInstance acquires the process lock file, ensuring that only one
+// client runs at a time. If another client is running, policy determines
+// what to do. wait limits policyWait.
+//
+// On success, releaseInstance must be called before exit. If this run should
+// be skipped, the error is a *runningError.
+func acquireInstance(ctx context.Context, policy string, wait time.Duration) error {
+	switch policy {
+	case policySkip, policyWait, policyKillOlder:
+	default:
+		return fmt.Errorf("unknown instance policy %q", policy)
+	}
+
+	path, err := instancePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating config directory: %v", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	var malformed bool
+	for {
+		ok, holder, err := tryAcquire(path)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heldInstance = path
+			return nil
+		}
+
+		switch {
+		case holder == nil:
+			// Released in the meantime. Try again.
+			continue
+		case holder.PID == 0:
+			// Malformed. Give the holder one chance to finish
+			// writing.
+			if malformed {
+				if err := removeStale(path, holder); err != nil {
+					return err
+				}
+				continue
+			}
+			malformed = true
+		case holder.PID == os.Getpid() || !processRunningSince(holder.PID, holder.Started):
+			// The lock file may hold our own PID if we were
+			// re-exec'd after an update. After a reboot, its PID
+			// may belong to an unrelated process.
+			if err := removeStale(path, holder); err != nil {
+				return err
+			}
+			continue
+		case policy == policySkip:
+			return &runningError{holder: *holder}
+		case policy == policyWait:
+			if time.Now().After(deadline) {
+				return &runningError{holder: *holder}
+			}
+			log.Infof("Waiting for client %+v to exit", holder)
+		case policy == policyKillOlder:
+			if err := killInstance(ctx, holder); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(instancePollInterval):
+		}
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/prattmic/restic-remote/log"
 	"github.com/spf13/pflag"
-	"github.com/spf13/viper"
 )
 
 // versionStr is the current version. It is overridden by the linker.
@@ -20,14 +21,19 @@ var (
 
 	// version prints the current version then exits.
 	version = pflag.Bool("version", false, "Print version and exit")
-
-	// resticWrap wraps runs restic with the client config.
-	resticWrap = pflag.Bool("restic", false, "Run restic with the config and following flags")
 )
 
 func main() {
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
-	pflag.Parse()
+
+	name, args := splitCommand(pflag.CommandLine, os.Args[1:])
+	if name == "help" {
+		usage()
+		os.Exit(0)
+	}
+	c := commands[name]
+	c.flags.AddFlagSet(pflag.CommandLine)
+	c.flags.Parse(args)
 
 	// Trick glog into thinking we called flag.Parse.
 	// https://github.com/kubernetes/kubernetes/issues/17162
@@ -38,56 +44,23 @@ func main() {
 		os.Exit(0)
 	}
 
-	readConfig()
-
-	if *resticWrap {
-		wrapRestic()
-	}
-
-	log.Infof("restic-remote client started")
-
-	ctx := context.Background()
-
-	a, err := newAPI(ctx)
-	if err != nil {
-		log.Exitf("Failed to create API: %v", err)
-	}
-
-	if err := a.ClientStarted(); err != nil {
-		log.Warningf("Error writing ClientStarted event: %v", err)
-	}
-
-	if err := updateCheck(ctx, a); err != nil {
-		log.Errorf("Unable to update: %v", err)
-	}
-
-	r, err := newRestic()
-	if err != nil {
-		log.Exitf("Failed to create restic: %v", err)
-	}
-
-	backup := viper.GetStringSlice("backup")
-	if len(backup) < 1 {
-		log.Exitf("Nothing to back up!")
-	}
-
-	log.Infof("Backing up %+v", backup)
-
-	if err := a.BackupStarted(backup); err != nil {
-		log.Warningf("Error writing BackupStarted event: %v", err)
-	}
-
-	so, se, err := r.Backup(backup)
-	message := fmt.Sprintf("stdout:\n%s\nstderr:\n%s", so, se)
-	log.Infof("restic backup: %s\n", message)
-	if err != nil {
-		if err := a.BackupFailed(message); err != nil {
-			log.Warningf("Error writing BackupFailed event: %v", err)
-		}
-		log.Exitf("Failed to backup: %v", err)
-	}
-
-	if err := a.BackupSucceeded(message); err != nil {
-		log.Warningf("Error writing BackupSucceeded event: %v", err)
-	}
+	// config validate reports a missing hostname along with any other
+	// problems, and setup asks for it.
+	readConfig(name != "config" && name != "setup")
+
+	// Cancel on interrupt so that restic is interrupted cleanly, releasing
+	// its repository lock. A second signal gets the default handling, so a
+	// stuck shutdown can still be interrupted.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		s := <-sigs
+		log.Warningf("Received %v, stopping", s)
+		cancel()
+		signal.Stop(sigs)
+	}()
+
+	c.run(ctx, c.flags.Args())
 }
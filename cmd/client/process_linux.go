@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// processExists returns true if a process with the given PID is running.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means the process exists, but belongs to another user.
+	return err == nil || err == syscall.EPERM
+}
+
+// terminateProcess asks the process with the given PID to exit.
+func terminateProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// killProcess forcibly kills the process with the given PID.
+func killProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// clockTicks is the kernel USER_HZ, the unit of process start times in
+// /proc. It is 100 on all common architectures.
+const clockTicks = 100
+
+// bootTime returns the time the system booted.
+func bootTime() (time.Time, error) {
+	b, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "btime ") {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "btime ")), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("malformed btime %q: %v", line, err)
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("btime missing from /proc/stat")
+}
+
+// processStartTime returns the time the process with the given PID started.
+func processStartTime(pid int) (time.Time, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The command name may contain spaces, so skip past it. starttime is
+	// field 22, the 20th after the command.
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("malformed stat %q", s)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed starttime %q: %v", fields[19], err)
+	}
+
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// processQueryLimitedInformation is the PROCESS_QUERY_LIMITED_INFORMATION
+	// access right.
+	processQueryLimitedInformation = 0x1000
+
+	// stillActive is the exit code of a process that has not exited.
+	stillActive = 259
+)
+
+// processExists returns true if a process with the given PID is running.
+func processExists(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err == syscall.ERROR_ACCESS_DENIED {
+		// The process exists, but belongs to another user.
+		return true
+	} else if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// terminateProcess asks the process with the given PID to exit.
+//
+// Windows has no way to ask a console-less process to exit, so it is killed.
+func terminateProcess(pid int) error {
+	return killProcess(pid)
+}
+
+// killProcess forcibly kills the process with the given PID.
+func killProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	defer p.Release()
+	return p.Kill()
+}
+
+// processStartTime returns the time the process with the given PID started.
+func processStartTime(pid int) (time.Time, error) {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer syscall.CloseHandle(h)
+
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, creation.Nanoseconds()), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prattmic/restic-remote/restic"
+	"github.com/spf13/viper"
+)
+
+// defaultProfile is the name of the profile built from the top-level config
+// when no profiles are configured.
+const defaultProfile = "default"
+
+// profile is a named set of paths that are backed up together.
+type profile struct {
+	// Name is the name of the profile, reported with each event.
+	Name string `mapstructure:"-"`
+
+	// Backup is the list of paths to back up.
+	Backup []string
+
+	// Stdin are commands whose output is backed up, each in its own
+	// snapshot.
+	Stdin []stdinSource
+
+	// Schedule is the minimum time between successful backups of this
+	// profile. 0 backs up on every run.
+	Schedule time.Duration
+
+	// Retention is the policy used to forget old snapshots after a
+	// successful backup. Nothing is forgotten if it is empty.
+	Retention restic.Retention
+
+	// Hooks are commands run around the backup.
+	Hooks hooks
+
+	// Retry is the policy for retrying failed backups.
+	Retry retryPolicy
+
+	// Restic is the restic configuration for this profile.
+	Restic restic.Config `mapstructure:"-"`
+}
+
+// stdinSource is a command whose output is backed up as a single file,
+// without writing it to local disk.
+type stdinSource struct {
+	// Filename is the name of the file in the snapshot.
+	Filename string
+
+	// Command writes the data to back up to stdout. It is run by the
+	// system shell.
+	Command string
+}
+
+// due returns true if the profile should be backed up, given the time of its
+// last successful backup.
+func (p *profile) due(last time.Time) bool {
+	return time.Since(last) >= p.Schedule
+}
+
+// decodeResticConfig decodes the restic config from settings, which may be nil.
+func decodeResticConfig(settings map[string]interface{}) (restic.Config, error) {
+	// Decode through viper so settings get the same conversions as the
+	// top-level config.
+	v := viper.New()
+	v.Set("restic", settings)
+
+	var c restic.Config
+	if err := v.UnmarshalKey("restic", &c); err != nil {
+		return c, fmt.Errorf("error unmarshalling restic config: %v", err)
+	}
+	return c, nil
+}
+
+// loadProfiles returns the configured profiles, sorted by name.
+//
+// Profiles are configured under the "profiles" key. Each profile's "restic"
+// settings override the top-level "restic" settings, and a profile without a
+// "retention" policy, "hooks" or "retry" policy uses the top-level ones. If
+// no profiles are configured, the top-level config is used as a single
+// profile.
+func loadProfiles() ([]profile, error) {
+	var retention restic.Retention
+	if err := viper.UnmarshalKey("retention", &retention); err != nil {
+		return nil, fmt.Errorf("error unmarshalling retention policy: %v", err)
+	}
+
+	var hs hooks
+	if err := viper.UnmarshalKey("hooks", &hs); err != nil {
+		return nil, fmt.Errorf("error unmarshalling hooks: %v", err)
+	}
+
+	var retry retryPolicy
+	if err := viper.UnmarshalKey("retry", &retry); err != nil {
+		return nil, fmt.Errorf("error unmarshalling retry policy: %v", err)
+	}
+
+	configured := viper.GetStringMap("profiles")
+	if len(configured) == 0 {
+		rconf, err := decodeResticConfig(viper.GetStringMap("restic"))
+		if err != nil {
+			return nil, err
+		}
+
+		return []profile{{
+			Name:      defaultProfile,
+			Backup:    viper.GetStringSlice("backup"),
+			Retention: retention,
+			Hooks:     hs,
+			Retry:     retry,
+			Restic:    rconf,
+		}}, nil
+	}
+
+	var names []string
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var profiles []profile
+	for _, name := range names {
+		key := "profiles." + name
+
+		p := profile{Name: name}
+		if !viper.IsSet(key + ".retention") {
+			p.Retention = retention
+		}
+		if !viper.IsSet(key + ".hooks") {
+			p.Hooks = hs
+		}
+		if !viper.IsSet(key + ".retry") {
+			p.Retry = retry
+		}
+		if err := viper.UnmarshalKey(key, &p); err != nil {
+			return nil, fmt.Errorf("error unmarshalling profile %q: %v", name, err)
+		}
+
+		// Profile restic settings replace individual top-level
+		// settings.
+		settings := make(map[string]interface{})
+		for k, v := range viper.GetStringMap("restic") {
+			settings[k] = v
+		}
+		for k, v := range viper.GetStringMap(key + ".restic") {
+			settings[k] = v
+		}
+
+		rconf, err := decodeResticConfig(settings)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %v", name, err)
+		}
+		p.Restic = rconf
+
+		profiles = append(profiles, p)
+	}
+
+	return profiles, nil
+}
+
+// findProfiles returns the profile named name, or all profiles if name is
+// empty.
+func findProfiles(name string) ([]profile, error) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return profiles, nil
+	}
+
+	for _, p := range profiles {
+		if p.Name == name {
+			return []profile{p}, nil
+		}
+	}
+	return nil, fmt.Errorf("no profile named %q", name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prattmic/restic-remote/api"
+	"github.com/prattmic/restic-remote/event"
+	"github.com/prattmic/restic-remote/log"
+	"github.com/prattmic/restic-remote/restic"
+	"github.com/spf13/viper"
+)
+
+// progressReporter reports backup progress to the API, at most once per
+// interval.
+type progressReporter struct {
+	a        *api.API
+	profile  string
+	interval time.Duration
+
+	mu sync.Mutex
+	// last is the time of the last report.
+	last time.Time
+	// sending is true while a report is being written.
+	sending bool
+}
+
+// newProgress returns a restic.ProgressFunc reporting progress of profile to
+// a, or nil if progress reporting is disabled.
+func newProgress(a *api.API, profile string) restic.ProgressFunc {
+	interval := viper.GetDuration("progress-interval")
+	if interval <= 0 {
+		return nil
+	}
+
+	p := &progressReporter{
+		a:        a,
+		profile:  profile,
+		interval: interval,
+	}
+	return p.update
+}
+
+// update reports rp if the interval has passed since the last report.
+//
+// Reports are written asynchronously so that restic's output is not blocked
+// by the API. Updates arriving while a report is being written are dropped.
+func (p *progressReporter) update(rp restic.Progress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sending || time.Since(p.last) < p.interval {
+		return
+	}
+	p.sending = true
+	p.last = time.Now()
+
+	ep := event.Progress{
+		PercentDone: rp.PercentDone,
+		BytesDone:   int64(rp.BytesDone),
+		TotalBytes:  int64(rp.TotalBytes),
+		FilesDone:   int64(rp.FilesDone),
+		TotalFiles:  int64(rp.TotalFiles),
+		ETA:         rp.ETA,
+	}
+
+	go func() {
+		if err := p.a.BackupProgress(p.profile, ep); err != nil {
+			log.Warningf("Error writing BackupProgress event: %v", err)
+		}
+
+		p.mu.Lock()
+		p.sending = false
+		p.mu.Unlock()
+	}()
+}
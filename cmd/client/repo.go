@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prattmic/restic-remote/log"
+)
+
+var (
+	// snapshotsProfile limits the snapshots command to one profile.
+	snapshotsProfile = snapshotsFlags.String("profile", "", "Only list snapshots of this profile")
+
+	// restoreProfile is the profile whose repository to restore from.
+	restoreProfile = restoreFlags.String("profile", "", "Profile to restore from (required if multiple profiles are configured)")
+
+	// restoreTarget is the directory to restore to.
+	restoreTarget = restoreFlags.String("target", "", "Directory to restore to (required)")
+
+	// restoreInclude limits the restored files.
+	restoreInclude = restoreFlags.StringSlice("include", nil, "Only restore files matching these patterns")
+
+	// checkProfile limits the check command to one profile.
+	checkProfile = checkFlags.String("profile", "", "Only check the repository of this profile")
+
+	// checkReadData reads all data during the check.
+	checkReadData = checkFlags.Bool("read-data", false, "Read and verify all data (slow)")
+)
+
+// runSnapshots implements the snapshots command. It lists the snapshots of
+// this host in the repository of each profile.
+func runSnapshots(ctx context.Context, args []string) {
+	if len(args) > 0 {
+		log.Exitf("Unexpected arguments: %v", args)
+	}
+
+	profiles, err := findProfiles(*snapshotsProfile)
+	if err != nil {
+		log.Exitf("Failed to load profiles: %v", err)
+	}
+
+	failed := 0
+	for _, p := range profiles {
+		r, err := newRestic(p.Restic)
+		if err != nil {
+			log.Exitf("Failed to create restic for profile %q: %v", p.Name, err)
+		}
+
+		so, err := r.Snapshots(ctx)
+		if err != nil {
+			log.Errorf("Failed to list snapshots of profile %q: %v", p.Name, err)
+			failed++
+			continue
+		}
+
+		if len(profiles) > 1 {
+			fmt.Printf("Profile %s:\n", p.Name)
+		}
+		fmt.Print(so)
+	}
+
+	if failed > 0 {
+		log.Exitf("%d of %d profiles failed", failed, len(profiles))
+	}
+}
+
+// runRestore implements the restore command. It restores a snapshot of one
+// profile.
+func runRestore(ctx context.Context, args []string) {
+	id := "latest"
+	switch len(args) {
+	case 0:
+	case 1:
+		id = args[0]
+	default:
+		log.Exitf("Unexpected arguments: %v", args[1:])
+	}
+
+	if *restoreTarget == "" {
+		log.Exitf("--target required")
+	}
+
+	profiles, err := findProfiles(*restoreProfile)
+	if err != nil {
+		log.Exitf("Failed to load profiles: %v", err)
+	}
+	if len(profiles) != 1 {
+		log.Exitf("Multiple profiles configured, --profile required")
+	}
+	p := profiles[0]
+
+	r, err := newRestic(p.Restic)
+	if err != nil {
+		log.Exitf("Failed to create restic: %v", err)
+	}
+
+	log.Infof("Restoring snapshot %s of profile %q to %s", id, p.Name, *restoreTarget)
+
+	so, err := r.Restore(ctx, id, *restoreTarget, *restoreInclude)
+	if err != nil {
+		log.Exitf("Failed to restore: %v", err)
+	}
+	fmt.Print(so)
+}
+
+// runCheck implements the check command. It checks the repository of each
+// profile.
+func runCheck(ctx context.Context, args []string) {
+	if len(args) > 0 {
+		log.Exitf("Unexpected arguments: %v", args)
+	}
+
+	profiles, err := findProfiles(*checkProfile)
+	if err != nil {
+		log.Exitf("Failed to load profiles: %v", err)
+	}
+
+	failed := 0
+	for _, p := range profiles {
+		r, err := newRestic(p.Restic)
+		if err != nil {
+			log.Exitf("Failed to create restic for profile %q: %v", p.Name, err)
+		}
+
+		log.Infof("Checking repository of profile %q", p.Name)
+
+		so, err := r.Check(ctx, *checkReadData)
+		if len(profiles) > 1 {
+			fmt.Printf("Profile %s:\n", p.Name)
+		}
+		fmt.Print(so)
+		if err != nil {
+			log.Errorf("Check of profile %q failed: %v", p.Name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		log.Exitf("%d of %d profiles failed", failed, len(profiles))
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prattmic/restic-remote/api"
+	"github.com/prattmic/restic-remote/log"
+	"github.com/prattmic/restic-remote/restic"
+)
+
+// Default retry backoff parameters.
+const (
+	defaultInitialBackoff = time.Minute
+	defaultMaxBackoff     = 30 * time.Minute
+	defaultMultiplier     = 2
+)
+
+// retryPolicy describes how failed backups are retried.
+type retryPolicy struct {
+	// MaxAttempts is the maximum number of backup attempts, including the
+	// first. 0 or 1 disables retries.
+	MaxAttempts int `mapstructure:"max-attempts"`
+
+	// InitialBackoff is the delay before the first retry. 0 uses
+	// defaultInitialBackoff.
+	InitialBackoff time.Duration `mapstructure:"initial-backoff"`
+
+	// MaxBackoff is the maximum delay between retries. 0 uses
+	// defaultMaxBackoff.
+	MaxBackoff time.Duration `mapstructure:"max-backoff"`
+
+	// Multiplier is the factor by which the delay increases after each
+	// retry. 0 uses defaultMultiplier.
+	Multiplier float64
+
+	// Retryable are the failure causes to retry, as reported in events
+	// (e.g., "backend", "locked", "timeout"). If empty, the restic
+	// failure classes that are likely transient are retried.
+	Retryable []string
+}
+
+// retryable returns true if failures with cause should be retried.
+func (p *retryPolicy) retryable(cause string) bool {
+	if len(p.Retryable) == 0 {
+		return restic.Class(cause).Retryable()
+	}
+	for _, c := range p.Retryable {
+		if c == cause {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before retrying after failed attempt n (starting
+// at 1).
+//
+// The delay grows exponentially, with jitter so that a fleet of clients that
+// failed at the same time don't all retry at the same time.
+func (p *retryPolicy) backoff(n int) time.Duration {
+	initial := p.InitialBackoff
+	if initial == 0 {
+		initial = defaultInitialBackoff
+	}
+	max := p.MaxBackoff
+	if max == 0 {
+		max = defaultMaxBackoff
+	}
+	mult := p.Multiplier
+	if mult == 0 {
+		mult = defaultMultiplier
+	}
+
+	d := float64(initial)
+	for i := 1; i < n && d < float64(max); i++ {
+		d *= mult
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+
+	// Wait between half and all of d.
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
+
+// attemptFunc makes a single backup attempt. It returns a message describing
+// the attempt and, on failure, the failure cause.
+type attemptFunc func() (cause, message string, err error)
+
+// retry calls f until it succeeds, fails with a cause that is not retryable,
+// or the maximum number of attempts is reached. Each failure that is retried
+// is reported to a.
+//
+// It returns the number of attempts made and the result of the final
+// attempt.
+func (p *retryPolicy) retry(ctx context.Context, a *api.API, profile string, f attemptFunc) (int, string, string, error) {
+	for n := 1; ; n++ {
+		cause, message, err := f()
+		if err == nil || n >= p.MaxAttempts || !p.retryable(cause) || ctx.Err() != nil {
+			return n, cause, message, err
+		}
+
+		d := p.backoff(n)
+		log.Warningf("Backup attempt %d of profile %q failed (%s), retrying in %v: %v", n, profile, cause, d, err)
+
+		m := fmt.Sprintf("attempt %d failed, retrying in %v: %v\n%s", n, d, err, message)
+		if err := a.BackupRetrying(profile, cause, n, m); err != nil {
+			log.Warningf("Error writing BackupRetrying event: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return n, cause, message, err
+		case <-time.After(d):
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/prattmic/restic-remote/restic"
+)
+
+// Secret reference prefixes. Config values for secrets may be a literal
+// secret, or a reference with one of these prefixes.
+const (
+	// secretFile reads the secret from a file. Trailing newlines are
+	// removed.
+	secretFile = "file:"
+
+	// secretEnv reads the secret from an environment variable.
+	secretEnv = "env:"
+
+	// secretCmd runs a command with the system shell, using its output as
+	// the secret. Trailing newlines are removed.
+	secretCmd = "cmd:"
+
+	// secretService looks up the secret in the Secret Service (e.g., GNOME
+	// Keyring or KWallet) by attributes, e.g.,
+	// "secret-service:service=restic-remote,account=repo". It requires
+	// secret-tool from libsecret. Trailing newlines are removed.
+	secretService = "secret-service:"
+)
+
+// isSecretRef returns true if v is a secret reference rather than a literal
+// secret.
+func isSecretRef(v string) bool {
+	for _, p := range []string{secretFile, secretEnv, secretCmd, secretService} {
+		if strings.HasPrefix(v, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecret returns the secret referred to by v. Values that are not
+// secret references are returned as-is.
+func resolveSecret(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, secretFile):
+		path := strings.TrimPrefix(v, secretFile)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading secret file: %v", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(v, secretEnv):
+		name := strings.TrimPrefix(v, secretEnv)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+		return s, nil
+	case strings.HasPrefix(v, secretCmd):
+		command := strings.TrimPrefix(v, secretCmd)
+		c := shellCommand(context.Background(), command)
+		var se bytes.Buffer
+		c.Stderr = &se
+		out, err := c.Output()
+		if err != nil {
+			return "", fmt.Errorf("secret command %q failed: %v: %s", command, err, se.String())
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	case strings.HasPrefix(v, secretService):
+		attrs, err := parseSecretAttrs(strings.TrimPrefix(v, secretService))
+		if err != nil {
+			return "", err
+		}
+		return lookupSecretService(attrs)
+	}
+
+	return v, nil
+}
+
+// parseSecretAttrs parses comma-separated key=value Secret Service
+// attributes.
+func parseSecretAttrs(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("malformed secret service attribute %q, want key=value", kv)
+		}
+		attrs[kv[:i]] = kv[i+1:]
+	}
+	return attrs, nil
+}
+
+// resolvePassword sets the password of rconf from a secret reference.
+//
+// Where possible, the password is handed to restic without placing it in
+// restic's environment: file references are passed via RESTIC_PASSWORD_FILE
+// and command references via '--password-command'. Command references run
+// with the system shell, as for other secrets.
+func resolvePassword(rconf *restic.Config) error {
+	v := rconf.Password
+	switch {
+	case strings.HasPrefix(v, secretFile):
+		rconf.PasswordFile = strings.TrimPrefix(v, secretFile)
+		rconf.Password = ""
+	case strings.HasPrefix(v, secretCmd):
+		if c, ok := passwordCommand(strings.TrimPrefix(v, secretCmd)); ok {
+			rconf.PasswordCommand = c
+			rconf.Password = ""
+			break
+		}
+		// restic cannot parse the quoted command, so run it here
+		// instead.
+		fallthrough
+	default:
+		p, err := resolveSecret(v)
+		if err != nil {
+			return fmt.Errorf("error resolving restic password: %v", err)
+		}
+		rconf.Password = p
+	}
+	return nil
+}
+
+// passwordCommand returns a '--password-command' value that runs command
+// with the system shell, exactly as shellCommand does.
+//
+// restic splits the value on whitespace, honouring single and double quotes
+// but not escapes, so each argument is quoted with whichever quote it does
+// not contain. ok is false if an argument cannot be quoted that way.
+func passwordCommand(command string) (c string, ok bool) {
+	args := shellCommand(context.Background(), command).Args
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		q := "'"
+		if strings.Contains(a, q) {
+			q = `"`
+		}
+		// A backslash before the closing quote escapes it.
+		if strings.Contains(a, q) || strings.HasSuffix(a, `\`) {
+			return "", false
+		}
+		quoted[i] = q + a + q
+	}
+	return strings.Join(quoted, " "), true
+}
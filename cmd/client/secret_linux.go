@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// secretTool is the libsecret command line tool used to access the Secret
+// Service.
+const secretTool = "secret-tool"
+
+// secretServiceAvailable returns an error if the Secret Service can't be
+// used.
+func secretServiceAvailable() error {
+	if _, err := exec.LookPath(secretTool); err != nil {
+		return fmt.Errorf("secret-service: references require %s from libsecret (e.g., package libsecret-tools): %v", secretTool, err)
+	}
+	return nil
+}
+
+// lookupSecretService looks up the secret with attrs in the Secret Service,
+// using secret-tool, which talks to the Secret Service over D-Bus. Trailing
+// newlines are removed.
+func lookupSecretService(attrs map[string]string) (string, error) {
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	args := []string{"lookup"}
+	for _, k := range keys {
+		args = append(args, k, attrs[k])
+	}
+
+	c := exec.Command(secretTool, args...)
+	var se bytes.Buffer
+	c.Stderr = &se
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("secret-tool lookup failed: %v: %s", err, se.String())
+	}
+	if len(out) == 0 {
+		return "", fmt.Errorf("no secret found for %v", attrs)
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
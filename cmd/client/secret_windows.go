@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+)
+
+// secretServiceAvailable returns an error, as the Secret Service is not
+// supported on Windows.
+func secretServiceAvailable() error {
+	return fmt.Errorf("secret-service: references are not supported on Windows")
+}
+
+// lookupSecretService is not supported on Windows.
+func lookupSecretService(attrs map[string]string) (string, error) {
+	return "", fmt.Errorf("secret service not supported on Windows")
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/prattmic/restic-remote/api"
+	"github.com/prattmic/restic-remote/binver"
+	"github.com/prattmic/restic-remote/log"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+	"google.golang.org/api/option"
+)
+
+// setupConfigFile is the name of the config file written by setup.
+const setupConfigFile = "config.yaml"
+
+var (
+	// setupPaths are the paths to back up.
+	setupPaths = setupFlags.StringSlice("paths", nil, "Paths to back up")
+
+	// setupInstallDir is where binaries are installed.
+	setupInstallDir = setupFlags.String("install-dir", "", "Directory to install restic and the client to (default <config dir>/bin)")
+
+	// setupInterval is the backup interval of the installed timer.
+	setupInterval = setupFlags.Duration("interval", time.Hour, "How often the installed timer runs backups")
+
+	// setupTimer installs the timer.
+	setupTimer = setupFlags.Bool("timer", true, "Install a systemd user timer (Linux) or scheduled task (Windows)")
+
+	// setupInit initializes missing repositories.
+	setupInit = setupFlags.Bool("init", true, "Initialize the repository if it does not exist")
+
+	// setupNonInteractive disables prompts.
+	setupNonInteractive = setupFlags.Bool("non-interactive", false, "Don't prompt; use flags and existing config only")
+
+	// setupEnrollmentToken enrolls with the server for per-host
+	// credentials.
+	setupEnrollmentToken = setupFlags.String("enrollment-token", "", "One-time enrollment token to obtain per-host API credentials")
+
+	// setupForce overwrites an existing config.
+	setupForce = setupFlags.Bool("force", false, "Overwrite an existing config file")
+)
+
+// setupField is a config value set by setup.
+type setupField struct {
+	// key is the viper key.
+	key string
+
+	// prompt describes the value.
+	prompt string
+
+	// optional fields may be left empty.
+	optional bool
+
+	// credential fields are API credentials, which are issued by the
+	// server when enrolling with a token.
+	credential bool
+
+	// secret fields are read without echoing them.
+	secret bool
+}
+
+// setupFields are the config values set by setup, in prompt order.
+var setupFields = []setupField{
+	{key: "hostname", prompt: "Hostname"},
+	{key: "restic.repository", prompt: "Restic repository"},
+	{key: "restic.password", prompt: "Restic password (or file:, env:, cmd:, secret-service: reference)", secret: true},
+	{key: "api.root", prompt: "API root URL"},
+	{key: "api.client-id", prompt: "API client ID", credential: true},
+	{key: "api.client-secret", prompt: "API client secret (or reference)", credential: true, secret: true},
+	{key: "api.audience", prompt: "API audience", credential: true},
+	{key: "api.token-url", prompt: "API token URL", credential: true},
+	{key: "google.project-number", prompt: "Google Cloud project number", optional: true},
+	{key: "google.credentials", prompt: "Google Cloud credentials JSON path", optional: true},
+	{key: "google.binary-bucket", prompt: "Release binary bucket", optional: true},
+}
+
+// prompter reads answers from the user.
+type prompter struct {
+	in *bufio.Reader
+}
+
+// ask prompts for a value, returning def if the answer is empty.
+func (p *prompter) ask(prompt, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", prompt, def)
+	} else {
+		fmt.Printf("%s: ", prompt)
+	}
+
+	s, err := p.in.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("error reading answer: %v", err)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	return s, nil
+}
+
+// askSecret prompts for a secret value, returning def if the answer is empty.
+// def is never shown, nor is the answer if stdin is a terminal.
+func (p *prompter) askSecret(prompt, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [unchanged]: ", prompt)
+	} else {
+		fmt.Printf("%s: ", prompt)
+	}
+
+	var s string
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		b, err := terminal.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", fmt.Errorf("error reading answer: %v", err)
+		}
+		s = string(b)
+	} else {
+		var err error
+		s, err = p.in.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("error reading answer: %v", err)
+		}
+	}
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	return s, nil
+}
+
+// runSetup implements the setup command. It writes the config, installs the
+// release binaries, prepares the repository, installs a timer, and reports
+// that the client started.
+func runSetup(ctx context.Context, args []string) {
+	if len(args) > 0 {
+		log.Exitf("Unexpected arguments: %v", args)
+	}
+	if configDir == "" {
+		log.Exitf("Unable to find config directory")
+	}
+
+	installDir := *setupInstallDir
+	if installDir == "" {
+		installDir = filepath.Join(configDir, "bin")
+	}
+
+	// Check before prompting or enrolling, so that neither is wasted.
+	path := filepath.Join(configDir, setupConfigFile)
+	if _, err := os.Stat(path); err == nil && !*setupForce {
+		log.Exitf("%s already exists (use --force to overwrite)", path)
+	}
+
+	values, paths, err := setupAsk()
+	if err != nil {
+		log.Exitf("Setup failed: %v", err)
+	}
+
+	// Use an existing restic if one is configured and there is no
+	// release to fetch it from.
+	resticPath := viper.GetString("restic.binary")
+	fetch := values["google.credentials"] != "" && values["google.binary-bucket"] != ""
+	if fetch || resticPath == "" {
+		resticPath = filepath.Join(installDir, exeName("restic"))
+	}
+	values["restic.binary"] = resticPath
+
+	// The enrollment token can only be redeemed once, so enroll only
+	// once nothing else can fail before the credentials are written.
+	if *setupEnrollmentToken != "" {
+		if err := setupEnroll(ctx, values); err != nil {
+			log.Exitf("Setup failed: %v", err)
+		}
+	}
+
+	if err := writeSetupConfig(path, values, paths); err != nil {
+		log.Exitf("Failed to write config: %v", err)
+	}
+	fmt.Printf("Wrote config to %s\n", path)
+
+	// Continue with exactly what was written.
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Exitf("Failed to read new config: %v", err)
+	}
+
+	a, err := newAPI(ctx)
+	if err != nil {
+		log.Exitf("Failed to create API: %v", err)
+	}
+
+	clientPath, err := os.Executable()
+	if err != nil {
+		log.Exitf("Unable to find client path: %v", err)
+	}
+	if fetch {
+		clientPath = filepath.Join(installDir, exeName("client"))
+		if err := installRelease(ctx, a, resticPath, clientPath); err != nil {
+			log.Exitf("Failed to install binaries: %v", err)
+		}
+	} else if _, err := os.Stat(resticPath); err != nil {
+		log.Exitf("No release bucket configured and no restic at %s: %v", resticPath, err)
+	}
+
+	if err := setupRepositories(ctx, a); err != nil {
+		log.Exitf("Failed to set up repository: %v", err)
+	}
+
+	if *setupTimer {
+		if err := installTimer(clientPath, path, *setupInterval); err != nil {
+			log.Exitf("Failed to install timer: %v", err)
+		}
+	}
+
+	// Send immediately, to check that the API credentials work.
+	err = a.ClientStarted()
+	if err == nil {
+		err = a.Flush()
+	}
+	if err != nil {
+		log.Exitf("Failed to report to API: %v", err)
+	}
+
+	fmt.Printf("Setup complete. Check with: %s status\n", clientPath)
+}
+
+// setupAsk returns the config values and backup paths, prompting for any
+// that are missing unless non-interactive.
+//
+// With an enrollment token, the API credentials are not asked for; the
+// caller obtains them from the server with setupEnroll.
+func setupAsk() (map[string]string, []string, error) {
+	p := &prompter{in: bufio.NewReader(os.Stdin)}
+
+	values := make(map[string]string)
+	for _, f := range setupFields {
+		if f.credential && *setupEnrollmentToken != "" {
+			continue
+		}
+
+		def := viper.GetString(f.key)
+		if f.key == "hostname" && def == "" {
+			def, _ = os.Hostname()
+		}
+
+		v := def
+		if !*setupNonInteractive {
+			var err error
+			if f.secret {
+				v, err = p.askSecret(f.prompt, def)
+			} else {
+				v, err = p.ask(f.prompt, def)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if v == "" && !f.optional {
+			return nil, nil, fmt.Errorf("%s required", f.key)
+		}
+		values[f.key] = v
+	}
+
+	paths := *setupPaths
+	if len(paths) == 0 {
+		paths = viper.GetStringSlice("backup")
+	}
+	if !*setupNonInteractive {
+		s, err := p.ask("Paths to back up (comma-separated)", strings.Join(paths, ","))
+		if err != nil {
+			return nil, nil, err
+		}
+		paths = nil
+		for _, path := range strings.Split(s, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil, fmt.Errorf("at least one backup path required")
+	}
+
+	return values, paths, nil
+}
+
+// setupEnroll exchanges the enrollment token for API credentials bound to
+// the hostname, adding them to values.
+func setupEnroll(ctx context.Context, values map[string]string) error {
+	conf, err := api.Enroll(ctx, values["api.root"], *setupEnrollmentToken, values["hostname"])
+	if err != nil {
+		return fmt.Errorf("failed to enroll: %v", err)
+	}
+
+	values["api.client-id"] = conf.ClientID
+	values["api.client-secret"] = conf.ClientSecret
+	values["api.audience"] = conf.Audience
+	values["api.token-url"] = conf.TokenURL
+
+	fmt.Printf("Enrolled %s with credential %s\n", values["hostname"], conf.ClientID)
+	return nil
+}
+
+// writeSetupConfig writes a config with values and backup paths to path.
+//
+// The config contains secrets, so it is only readable by the current user.
+func writeSetupConfig(path string, values map[string]string, paths []string) error {
+	// YAML double-quoted strings accept Go's escapes.
+	q := strconv.Quote
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Written by '%s setup'. See config.sample.yaml for all options.\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(&b, "hostname: %s\n", q(values["hostname"]))
+	fmt.Fprintf(&b, "backup:\n")
+	for _, p := range paths {
+		fmt.Fprintf(&b, "  - %s\n", q(p))
+	}
+
+	section := ""
+	for _, k := range append([]string{"restic.binary"}, keys(values)...) {
+		i := strings.Index(k, ".")
+		if i < 0 || values[k] == "" {
+			continue
+		}
+		if s := k[:i]; s != section {
+			section = s
+			fmt.Fprintf(&b, "\n%s:\n", section)
+		}
+		fmt.Fprintf(&b, "  %s: %s\n", k[i+1:], q(values[k]))
+	}
+
+	return writeFileAtomic(path, []byte(b.String()))
+}
+
+// keys returns the setupFields keys present in values, in prompt order.
+func keys(values map[string]string) []string {
+	var ks []string
+	for _, f := range setupFields {
+		if _, ok := values[f.key]; ok {
+			ks = append(ks, f.key)
+		}
+	}
+	return ks
+}
+
+// exeName returns the file name of binary name on this OS.
+func exeName(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// installRelease installs the restic and client binaries of the current
+// release to resticPath and clientPath, unless they are already up to date.
+func installRelease(ctx context.Context, a *api.API, resticPath, clientPath string) error {
+	release, err := a.GetRelease()
+	if err != nil {
+		return fmt.Errorf("error getting current release: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(resticPath), 0755); err != nil {
+		return fmt.Errorf("error creating install directory: %v", err)
+	}
+
+	c, err := storage.NewClient(ctx, option.WithCredentialsFile(viper.GetString("google.credentials")))
+	if err != nil {
+		return fmt.Errorf("error creating storage client: %v", err)
+	}
+	bkt := c.Bucket(viper.GetString("google.binary-bucket"))
+
+	bins := []struct {
+		path    string
+		want    string
+		version func(context.Context, string) (string, error)
+	}{
+		{resticPath, release.ResticVersion, binver.Restic},
+		{clientPath, release.ClientVersion, binver.Client},
+	}
+	for _, bin := range bins {
+		if v, err := bin.version(ctx, bin.path); err == nil && v == bin.want {
+			log.Infof("%s is up to date", bin.path)
+			continue
+		}
+
+		tmp, err := downloadToTmp(ctx, bkt, release, bin.path)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+
+		v, err := bin.version(ctx, tmp)
+		if err != nil {
+			return fmt.Errorf("error getting version of %s: %v", tmp, err)
+		}
+		if v != bin.want {
+			return fmt.Errorf("%s version mismatch got %q want %q", filepath.Base(bin.path), v, bin.want)
+		}
+
+		if err := os.Rename(tmp, bin.path); err != nil {
+			return fmt.Errorf("error installing %s: %v", bin.path, err)
+		}
+		fmt.Printf("Installed %s\n", bin.path)
+	}
+
+	return nil
+}
+
+// setupRepositories checks that the repository of each profile exists,
+// initializing it if allowed.
+func setupRepositories(ctx context.Context, a *api.API) error {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range profiles {
+		r, err := newRestic(p.Restic)
+		if err != nil {
+			return err
+		}
+
+		exists, err := r.RepositoryExists(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to open repository: %v", err)
+		}
+		if exists {
+			fmt.Printf("Repository %s OK\n", p.Restic.Repository)
+			continue
+		}
+		if !*setupInit {
+			return fmt.Errorf("repository %s does not exist", p.Restic.Repository)
+		}
+
+		so, err := r.Init(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to initialize repository: %v", err)
+		}
+		fmt.Printf("Initialized repository %s\n", p.Restic.Repository)
+
+		if err := a.RepositoryInitialized(p.Name, so); err != nil {
+			log.Warningf("Error writing RepositoryInitialized event: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prattmic/restic-remote/config"
+)
+
+// timerName is the name of the systemd units installed by setup.
+const timerName = "restic-remote"
+
+const serviceUnit = `[Unit]
+Description=restic-remote backup
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s --config %s backup
+`
+
+const timerUnit = `[Unit]
+Description=Run restic-remote backup periodically
+
+[Timer]
+OnBootSec=5min
+OnUnitActiveSec=%ds
+
+[Install]
+WantedBy=timers.target
+`
+
+// installTimer installs and starts a systemd user timer running client with
+// configPath every interval.
+func installTimer(client, configPath string, interval time.Duration) error {
+	cd, err := config.Dir("systemd")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(cd, "user")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", dir, err)
+	}
+
+	service := fmt.Sprintf(serviceUnit, strconv.Quote(client), strconv.Quote(configPath))
+	if err := ioutil.WriteFile(filepath.Join(dir, timerName+".service"), []byte(service), 0644); err != nil {
+		return fmt.Errorf("error writing service: %v", err)
+	}
+	timer := fmt.Sprintf(timerUnit, int(interval.Seconds()))
+	if err := ioutil.WriteFile(filepath.Join(dir, timerName+".timer"), []byte(timer), 0644); err != nil {
+		return fmt.Errorf("error writing timer: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"--user", "daemon-reload"},
+		{"--user", "enable", "--now", timerName + ".timer"},
+	} {
+		if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("systemctl %v failed: %v: %s", args, err, out)
+		}
+	}
+
+	fmt.Printf("Installed systemd user timer %s.timer\n", timerName)
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// timerName is the name of the scheduled task installed by setup.
+const timerName = "restic-remote"
+
+// installTimer installs a scheduled task running client with configPath
+// every interval.
+func installTimer(client, configPath string, interval time.Duration) error {
+	minutes := int(interval.Minutes())
+	if minutes < 1 {
+		minutes = 1
+	}
+
+	// The task command line is parsed like any other Windows command
+	// line, which doesn't treat backslashes in paths as escapes.
+	run := fmt.Sprintf("%s --config %s backup", syscall.EscapeArg(client), syscall.EscapeArg(configPath))
+	args := []string{"/Create", "/F", "/TN", timerName, "/SC", "MINUTE", "/MO", strconv.Itoa(minutes), "/TR", run}
+	if out, err := exec.Command("schtasks", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("schtasks %v failed: %v: %s", args, err, out)
+	}
+
+	fmt.Printf("Installed scheduled task %s\n", timerName)
+	return nil
+}
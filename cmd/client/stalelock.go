@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prattmic/restic-remote/api"
+	"github.com/prattmic/restic-remote/log"
+	"github.com/prattmic/restic-remote/restic"
+	"github.com/spf13/viper"
+)
+
+// unlockMargin is how long before restic.UnlockAge the locks of other
+// machines are considered at risk of removal by 'restic unlock'. restic
+// refreshes the locks of running processes every 5 minutes.
+const unlockMargin = 5 * time.Minute
+
+// staleLocks returns the locks that were created on this machine more than
+// age ago by restic processes that are no longer running, and the locks of
+// other machines that 'restic unlock' would remove.
+func staleLocks(locks []restic.Lock, age time.Duration) (stale, foreign []restic.Lock, err error) {
+	// restic records the system hostname, not the configured hostname.
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting hostname: %v", err)
+	}
+
+	for _, l := range locks {
+		if l.Hostname != host {
+			if time.Since(l.Time) >= restic.UnlockAge-unlockMargin {
+				foreign = append(foreign, l)
+			}
+			continue
+		}
+		if time.Since(l.Time) < age {
+			continue
+		}
+		if processRunningSince(l.PID, l.Time) {
+			continue
+		}
+		stale = append(stale, l)
+	}
+
+	return stale, foreign, nil
+}
+
+// removeStaleLocks removes locks left in the repository by restic processes
+// on this machine that are no longer running, such as when the machine lost
+// power during a backup.
+//
+// Only locks older than the "stale-lock-age" config are removed. 0 disables
+// removal.
+//
+// restic can't remove individual locks, so this runs 'restic unlock', which
+// also removes locks from any machine that are more than 30 minutes old. To
+// only remove this machine's locks, nothing is removed while another
+// machine has a lock that old; the stale locks are reported in the error
+// instead. Every lock that was removed is reported.
+func removeStaleLocks(ctx context.Context, a *api.API, r *restic.Restic, p *profile) error {
+	age := viper.GetDuration("stale-lock-age")
+	if age <= 0 {
+		return nil
+	}
+
+	before, err := r.Locks(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing locks: %v", err)
+	}
+
+	stale, foreign, err := staleLocks(before, age)
+	if err != nil {
+		return err
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	if len(foreign) > 0 {
+		return fmt.Errorf("not removing stale locks %+v, as 'restic unlock' would also remove the locks of other machines: %+v", stale, foreign)
+	}
+
+	log.Warningf("Removing stale locks: %+v", stale)
+
+	if err := r.Unlock(ctx); err != nil {
+		return fmt.Errorf("error removing stale locks: %v", err)
+	}
+
+	// Check which locks restic actually removed.
+	after, err := r.Locks(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing locks: %v", err)
+	}
+	remaining := make(map[string]bool, len(after))
+	for _, l := range after {
+		remaining[l.ID] = true
+	}
+
+	for _, l := range stale {
+		if remaining[l.ID] {
+			log.Warningf("Stale lock %s was not removed", l.ID)
+		}
+	}
+
+	selected := make(map[string]bool, len(stale))
+	for _, l := range stale {
+		selected[l.ID] = true
+	}
+
+	for _, l := range before {
+		if remaining[l.ID] {
+			continue
+		}
+
+		// Locks we didn't select are this machine's locks that are
+		// younger than stale-lock-age, or were released by their
+		// holder in the meantime.
+		how := "removed"
+		if !selected[l.ID] {
+			how = "removed by restic unlock (or released)"
+		}
+		message := fmt.Sprintf("%s lock %s held by %s@%s (pid %d) since %v", how, l.ID, l.Username, l.Hostname, l.PID, l.Time)
+		log.Infof("Stale lock: %s", message)
+		if err := a.StaleLockRemoved(p.Name, message); err != nil {
+			log.Warningf("Error writing StaleLockRemoved event: %v", err)
+		}
+	}
+
+	return nil
+}
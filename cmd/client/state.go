@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFile is the name of the client state file in the config directory.
+const stateFile = "state.json"
+
+// state is persistent client state, stored in the config directory.
+type state struct {
+	// LastBackup is the time of the last successful backup of each
+	// profile.
+	LastBackup map[string]time.Time
+}
+
+// statePath returns the path to the state file.
+func statePath() (string, error) {
+	if configDir == "" {
+		return "", fmt.Errorf("config directory unknown")
+	}
+	return filepath.Join(configDir, stateFile), nil
+}
+
+// readState reads the client state. A missing state file results in empty
+// state.
+func readState() (*state, error) {
+	s := &state{
+		LastBackup: make(map[string]time.Time),
+	}
+
+	p, err := statePath()
+	if err != nil {
+		return s, err
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, fmt.Errorf("error reading state: %v", err)
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return s, fmt.Errorf("error decoding state %q: %v", string(b), err)
+	}
+	if s.LastBackup == nil {
+		s.LastBackup = make(map[string]time.Time)
+	}
+
+	return s, nil
+}
+
+// write writes the client state to the state file.
+func (s *state) write() error {
+	p, err := statePath()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state %+v: %v", s, err)
+	}
+
+	return writeFileAtomic(p, b)
+}
+
+// writeFileAtomic writes b to the file at p, creating its directory if
+// necessary.
+//
+// It writes to a temporary file first so that a crash doesn't leave a
+// truncated file.
+func writeFileAtomic(p string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("error creating config directory: %v", err)
+	}
+
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("error writing %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return fmt.Errorf("error replacing %s: %v", p, err)
+	}
+
+	return nil
+}
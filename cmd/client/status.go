@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prattmic/restic-remote/log"
+)
+
+var (
+	// statusJSON prints status as JSON.
+	statusJSON = statusFlags.Bool("json", false, "Print status as JSON")
+
+	// historyJSON prints history as JSON.
+	historyJSON = historyFlags.Bool("json", false, "Print history as JSON")
+
+	// historyLimit limits the number of history entries printed.
+	historyLimit = historyFlags.Int("limit", 20, "Maximum number of history entries to print (0 for all)")
+)
+
+// recordSkipped records a run skipped entirely for reason in the history.
+func recordSkipped(start time.Time, reason string) {
+	h := historyEntry{
+		Start:  start,
+		End:    time.Now(),
+		Result: resultSkipped,
+		Error:  reason,
+	}
+	if err := recordHistory(&h); err != nil {
+		log.Warningf("Unable to record history: %v", err)
+	}
+}
+
+// profileStatus is the backup status of a single profile.
+type profileStatus struct {
+	// Profile is the profile name.
+	Profile string
+
+	// LastSuccess is the time of the last successful backup, if any.
+	LastSuccess time.Time
+
+	// NextDue is the earliest time of the next backup, if the profile has
+	// a schedule.
+	NextDue time.Time `json:",omitempty"`
+
+	// LastRun is the most recent run of the profile, if any.
+	LastRun *historyEntry `json:",omitempty"`
+}
+
+// printJSON prints v as indented JSON to stdout.
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Exitf("Failed to encode JSON: %v", err)
+	}
+	fmt.Printf("%s\n", b)
+}
+
+// formatTime formats t for display, or "never" for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// runStatus implements the status command. It prints the backup status of
+// each profile.
+func runStatus(ctx context.Context, args []string) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		log.Exitf("Failed to load profiles: %v", err)
+	}
+
+	st, err := readState()
+	if err != nil {
+		log.Warningf("Unable to read state: %v", err)
+	}
+
+	h, err := readHistory()
+	if err != nil {
+		log.Warningf("Unable to read history: %v", err)
+	}
+
+	var statuses []profileStatus
+	for _, p := range profiles {
+		s := profileStatus{
+			Profile:     p.Name,
+			LastSuccess: st.LastBackup[p.Name],
+		}
+		if p.Schedule > 0 && !s.LastSuccess.IsZero() {
+			s.NextDue = s.LastSuccess.Add(p.Schedule)
+		}
+		for i := len(h) - 1; i >= 0; i-- {
+			if h[i].Profile == p.Name {
+				s.LastRun = &h[i]
+				break
+			}
+		}
+		statuses = append(statuses, s)
+	}
+
+	if *statusJSON {
+		printJSON(statuses)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PROFILE\tLAST SUCCESS\tLAST RUN\tRESULT\tNEXT DUE\n")
+	for _, s := range statuses {
+		lastRun, result := "never", "-"
+		if s.LastRun != nil {
+			lastRun = formatTime(s.LastRun.Start)
+			result = s.LastRun.Result
+		}
+		next := "every run"
+		if !s.NextDue.IsZero() {
+			next = formatTime(s.NextDue)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Profile, formatTime(s.LastSuccess), lastRun, result, next)
+	}
+	w.Flush()
+
+	for _, s := range statuses {
+		if s.LastRun != nil && s.LastRun.Error != "" {
+			fmt.Printf("\n%s: %s\n", s.Profile, s.LastRun.Error)
+		}
+	}
+}
+
+// runHistory implements the history command. It prints the run history,
+// newest first.
+func runHistory(ctx context.Context, args []string) {
+	h, err := readHistory()
+	if err != nil {
+		log.Exitf("Failed to read history: %v", err)
+	}
+
+	// Newest first.
+	for i, j := 0, len(h)-1; i < j; i, j = i+1, j-1 {
+		h[i], h[j] = h[j], h[i]
+	}
+	if *historyLimit > 0 && len(h) > *historyLimit {
+		h = h[:*historyLimit]
+	}
+
+	if *historyJSON {
+		if h == nil {
+			h = []historyEntry{}
+		}
+		printJSON(h)
+		return
+	}
+
+	for _, e := range h {
+		profile := e.Profile
+		if profile == "" {
+			profile = "(all)"
+		}
+		fmt.Printf("%s  %-10s %-9s %v\n", formatTime(e.Start), profile, e.Result, e.End.Sub(e.Start).Round(time.Second))
+		if len(e.SnapshotIDs) > 0 {
+			fmt.Printf("    snapshots: %s\n", strings.Join(e.SnapshotIDs, " "))
+		}
+		for _, s := range e.Summary {
+			fmt.Printf("    %s\n", s)
+		}
+		if e.Error != "" {
+			fmt.Printf("    error: %s\n", e.Error)
+		}
+	}
+}
@@ -26,6 +26,9 @@ type updateOpts struct {
 	resticPath string
 	clientPath string
 
+	// resticVersion is the version of the current restic.
+	resticVersion string
+
 	googleCredsFile string
 
 	// binaryBucket is the GCS bucket containing the binaries referenced in
@@ -33,6 +36,26 @@ type updateOpts struct {
 	binaryBucket string
 }
 
+// runUpdate implements the update command. It reports the current versions
+// and installs any new release, even if updates are disabled for backups.
+func runUpdate(ctx context.Context, args []string) {
+	if len(args) > 0 {
+		log.Exitf("Unexpected arguments: %v", args)
+	}
+
+	a, err := newAPI(ctx)
+	if err != nil {
+		log.Exitf("Failed to create API: %v", err)
+	}
+
+	viper.Set("update", true)
+	err = updateCheck(ctx, a)
+	flushEvents(a)
+	if err != nil {
+		log.Exitf("Unable to update: %v", err)
+	}
+}
+
 func updateCheck(ctx context.Context, a *api.API) error {
 	// Report the current versions to the API.
 	if err := a.ClientVersion(versionStr); err != nil {
@@ -44,7 +67,7 @@ func updateCheck(ctx context.Context, a *api.API) error {
 		return fmt.Errorf("restic path unknown")
 	}
 
-	rver, err := binver.Restic(resticPath)
+	rver, err := binver.Restic(ctx, resticPath)
 	if err != nil {
 		return fmt.Errorf("error getting restic version: %v", err)
 	}
@@ -69,8 +92,9 @@ func updateCheck(ctx context.Context, a *api.API) error {
 	log.Infof("Latest release: %+v", release)
 
 	opts := updateOpts{
-		release:    release,
-		resticPath: resticPath,
+		release:       release,
+		resticPath:    resticPath,
+		resticVersion: rver,
 	}
 
 	opts.googleCredsFile = viper.GetString("google.credentials")
@@ -173,14 +197,14 @@ func performUpdate(ctx context.Context, a *api.API, opts updateOpts) error {
 		defer os.Remove(tmpClient)
 	}
 
-	return checkAndInstall(a, opts, tmpRestic, tmpClient)
+	return checkAndInstall(ctx, a, opts, tmpRestic, tmpClient)
 }
 
-func checkAndInstall(a *api.API, opts updateOpts, tmpRestic, tmpClient string) (err error) {
+func checkAndInstall(ctx context.Context, a *api.API, opts updateOpts, tmpRestic, tmpClient string) (err error) {
 	// Make sure we got working binaries with the correct versions.
 
 	if opts.updateRestic {
-		version, err := binver.Restic(tmpRestic)
+		version, err := binver.Restic(ctx, tmpRestic)
 		if err != nil {
 			return fmt.Errorf("error getting version of new restic %s: %v", tmpRestic, err)
 		}
@@ -189,7 +213,7 @@ func checkAndInstall(a *api.API, opts updateOpts, tmpRestic, tmpClient string) (
 		}
 	}
 	if opts.updateClient {
-		version, err := binver.Client(tmpClient)
+		version, err := binver.Client(ctx, tmpClient)
 		if err != nil {
 			return fmt.Errorf("error getting version of new client %s: %v", tmpClient, err)
 		}
@@ -237,13 +261,18 @@ func checkAndInstall(a *api.API, opts updateOpts, tmpRestic, tmpClient string) (
 		}
 	}
 
-	if err := a.UpdateComplete(opts.release); err != nil {
+	from := &api.Release{
+		ClientVersion: versionStr,
+		ResticVersion: opts.resticVersion,
+	}
+	if err := a.UpdateComplete(from, opts.release); err != nil {
 		log.Errorf("Error reporting update complete: %v", err)
 	}
 
 	// Success! Re-exec to the new version. This isn't actually needed if
 	// we only updated restic, but it is simple enough to restart.
 	log.Infof("Updated, restarting...")
+	finish(a)
 	execve(opts.clientPath, os.Args[1:], os.Environ())
 
 	return nil
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/prattmic/restic-remote/auth0"
+	"github.com/prattmic/restic-remote/binver"
+	"github.com/prattmic/restic-remote/log"
+	"github.com/spf13/viper"
+)
+
+// liveChecks performs live checks against the API and repositories.
+var liveChecks = configFlags.Bool("live", false, "With validate, also check connectivity to the API and repositories")
+
+// problems collects configuration problems.
+type problems []string
+
+// addf adds a problem in section.
+func (p *problems) addf(section, format string, args ...interface{}) {
+	*p = append(*p, section+": "+fmt.Sprintf(format, args...))
+}
+
+// runConfig implements the config command. Its only subcommand is validate.
+func runConfig(ctx context.Context, args []string) {
+	if len(args) != 1 || args[0] != "validate" {
+		log.Exitf("Usage: config validate [--live]")
+	}
+
+	var p problems
+	profiles := validateConfig(&p)
+	if *liveChecks && len(p) == 0 {
+		validateLive(ctx, &p, profiles)
+	}
+
+	if len(p) > 0 {
+		fmt.Printf("Found %d problems:\n", len(p))
+		for _, s := range p {
+			fmt.Printf("  - %s\n", s)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Printf("Config OK (%d profiles)\n", len(profiles))
+}
+
+// validateConfig checks the merged config, adding any problems to p. It
+// returns the profiles that could be loaded.
+func validateConfig(p *problems) []profile {
+	if configErr != nil {
+		p.addf("config", "unable to read config file: %v", configErr)
+	}
+	if viper.GetString("hostname") == "" {
+		p.addf("hostname", "must be set")
+	}
+
+	validateSecret(p, "api", "client-secret", viper.GetString("api.client-secret"))
+	validateSecret(p, "api", "token", viper.GetString("api.token"))
+	validateAPI(p)
+	validateGoogle(p)
+	validateClient(p)
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		p.addf("profiles", "%v", err)
+		return nil
+	}
+	for i := range profiles {
+		validateProfile(p, &profiles[i])
+	}
+
+	return profiles
+}
+
+// validateSecret checks that the secret reference v, named name, can be
+// resolved.
+//
+// Command and Secret Service references are only resolved with live checks,
+// as they may run arbitrary commands or prompt to unlock a keyring.
+func validateSecret(p *problems, section, name, v string) {
+	if !isSecretRef(v) {
+		return
+	}
+	if strings.HasPrefix(v, secretService) {
+		if err := secretServiceAvailable(); err != nil {
+			p.addf(section, "%s: %v", name, err)
+			return
+		}
+	}
+	if !*liveChecks && (strings.HasPrefix(v, secretCmd) || strings.HasPrefix(v, secretService)) {
+		return
+	}
+	if _, err := resolveSecret(v); err != nil {
+		p.addf(section, "%s: %v", name, err)
+	}
+}
+
+// apiRequired are the keys in the "api" section required by each
+// authentication provider, in addition to root.
+var apiRequired = map[string][]string{
+	auth0.ProviderAuth0:  {"client-id", "client-secret", "audience", "token-url"},
+	auth0.ProviderOIDC:   {"client-id", "client-secret", "token-url"},
+	auth0.ProviderStatic: {"token"},
+	auth0.ProviderMTLS:   {"cert-file", "key-file"},
+}
+
+// validateAPI checks the "api" section.
+func validateAPI(p *problems) {
+	provider := viper.GetString("api.provider")
+	required, ok := apiRequired[provider]
+	if !ok {
+		p.addf("api", "unknown provider %q", provider)
+	}
+
+	for _, k := range append([]string{"root"}, required...) {
+		if viper.GetString("api."+k) == "" {
+			p.addf("api", "%s must be set for provider %s", k, provider)
+		}
+	}
+
+	for _, k := range []string{"cert-file", "key-file", "ca-file"} {
+		v := viper.GetString("api." + k)
+		if v == "" {
+			continue
+		}
+		if _, err := os.Stat(v); err != nil {
+			p.addf("api", "%s: %v", k, err)
+		}
+	}
+
+	if v := viper.GetString("api.timeout"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil {
+			p.addf("api", "malformed timeout %q: %v", v, err)
+		} else if d <= 0 {
+			p.addf("api", "timeout must be positive")
+		}
+	}
+	if v := viper.GetString("api.batch-delay"); v != "" {
+		if _, err := time.ParseDuration(v); err != nil {
+			p.addf("api", "malformed batch-delay %q: %v", v, err)
+		}
+	}
+
+	for _, k := range []string{"root", "token-url"} {
+		v := viper.GetString("api." + k)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			p.addf("api", "malformed %s %q: %v", k, v, err)
+		} else if u.Scheme == "" || u.Host == "" {
+			p.addf("api", "%s %q must be an absolute URL", k, v)
+		}
+	}
+}
+
+// validateGoogle checks the "google" section.
+func validateGoogle(p *problems) {
+	creds := viper.GetString("google.credentials")
+	if creds != "" {
+		b, err := ioutil.ReadFile(creds)
+		if err != nil {
+			p.addf("google", "unable to read credentials: %v", err)
+		} else {
+			var c struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(b, &c); err != nil {
+				p.addf("google", "malformed credentials %s: %v", creds, err)
+			} else if c.Type == "" {
+				p.addf("google", "credentials %s missing type", creds)
+			}
+		}
+	}
+
+	if viper.GetBool("update") {
+		if creds == "" {
+			p.addf("google", "credentials must be set for updates (or set update: false)")
+		}
+		if viper.GetString("google.binary-bucket") == "" {
+			p.addf("google", "binary-bucket must be set for updates (or set update: false)")
+		}
+	}
+}
+
+// validateClient checks the top-level client options.
+func validateClient(p *problems) {
+	switch policy := viper.GetString("instance-policy"); policy {
+	case policySkip, policyWait, policyKillOlder:
+	default:
+		p.addf("instance-policy", "unknown policy %q (want %s, %s, or %s)", policy, policySkip, policyWait, policyKillOlder)
+	}
+
+	for _, k := range []string{"instance-wait", "stale-lock-age", "progress-interval"} {
+		v := viper.GetString(k)
+		if v == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(v); err != nil {
+			p.addf(k, "malformed duration %q: %v", v, err)
+		}
+	}
+
+	var conds conditions
+	if err := viper.UnmarshalKey("conditions", &conds); err != nil {
+		p.addf("conditions", "%v", err)
+	}
+	for _, k := range unsupportedConditions(&conds) {
+		p.addf("conditions", "%s is not supported on %s, so every run would be skipped", k, runtime.GOOS)
+	}
+}
+
+// validateProfile checks profile pr.
+func validateProfile(p *problems, pr *profile) {
+	section := fmt.Sprintf("profile %q", pr.Name)
+
+	if len(pr.Backup) == 0 && len(pr.Stdin) == 0 {
+		p.addf(section, "nothing to back up")
+	}
+	for _, path := range pr.Backup {
+		f, err := os.Open(path)
+		if err != nil {
+			p.addf(section, "backup path not readable: %v", err)
+			continue
+		}
+		f.Close()
+	}
+	for _, s := range pr.Stdin {
+		if s.Filename == "" {
+			p.addf(section, "stdin source %q missing filename", s.Command)
+		}
+		if s.Command == "" {
+			p.addf(section, "stdin source %q missing command", s.Filename)
+		}
+	}
+
+	if pr.Schedule < 0 {
+		p.addf(section, "negative schedule %v", pr.Schedule)
+	}
+	if pr.Retry.MaxAttempts < 0 {
+		p.addf(section, "negative retry max-attempts %d", pr.Retry.MaxAttempts)
+	}
+
+	stages := []struct {
+		name  string
+		hooks []hook
+	}{
+		{"pre", pr.Hooks.Pre},
+		{"post", pr.Hooks.Post},
+		{"on-failure", pr.Hooks.OnFailure},
+	}
+	for _, st := range stages {
+		for i, h := range st.hooks {
+			if strings.TrimSpace(h.Command) == "" {
+				p.addf(section, "%s hook %d missing command", st.name, i)
+			}
+		}
+	}
+
+	rc := pr.Restic
+	if rc.Binary == "" {
+		p.addf(section, "restic binary must be set")
+	} else if fi, err := os.Stat(rc.Binary); err != nil {
+		p.addf(section, "restic binary: %v", err)
+	} else if !fi.Mode().IsRegular() {
+		p.addf(section, "restic binary %s is not a regular file", rc.Binary)
+	} else if runtime.GOOS != "windows" && fi.Mode()&0111 == 0 {
+		p.addf(section, "restic binary %s is not executable", rc.Binary)
+	}
+	if rc.Repository == "" {
+		p.addf(section, "restic repository must be set")
+	}
+	if rc.Password == "" {
+		p.addf(section, "restic password must be set")
+	} else {
+		validateSecret(p, section, "restic password", rc.Password)
+	}
+	for _, f := range rc.ExcludeFile {
+		if _, err := ioutil.ReadFile(f); err != nil {
+			p.addf(section, "exclude file not readable: %v", err)
+		}
+	}
+	if strings.HasPrefix(rc.Repository, "gs:") && viper.GetString("google.credentials") == "" {
+		p.addf(section, "GCS repository requires google.credentials")
+	}
+}
+
+// validateLive checks connectivity to the API and the repository of each
+// profile, adding any problems to p.
+func validateLive(ctx context.Context, p *problems, profiles []profile) {
+	a, err := newAPI(ctx)
+	if err != nil {
+		p.addf("api", "%v", err)
+	} else if _, err := a.GetRelease(); err != nil {
+		p.addf("api", "unable to reach API: %v", err)
+	}
+
+	for _, pr := range profiles {
+		section := fmt.Sprintf("profile %q", pr.Name)
+
+		if _, err := binver.Restic(ctx, pr.Restic.Binary); err != nil {
+			p.addf(section, "unable to run restic: %v", err)
+			continue
+		}
+
+		r, err := newRestic(pr.Restic)
+		if err != nil {
+			p.addf(section, "%v", err)
+			continue
+		}
+
+		exists, err := r.RepositoryExists(ctx)
+		if err != nil {
+			p.addf(section, "unable to open repository: %v", err)
+		} else if !exists && !pr.Restic.AutoInit {
+			p.addf(section, "repository does not exist (set restic.auto-init to create it)")
+		}
+	}
+}
@@ -1,27 +1,33 @@
 package main
 
 import (
-	"os"
+	"context"
 
 	"github.com/prattmic/restic-remote/log"
-	"github.com/spf13/pflag"
-	"github.com/spf13/viper"
 )
 
-// wrapRestic exec's restic with the client config.
-func wrapRestic() {
-	bin := viper.GetString("restic.binary")
-	if bin == "" {
-		log.Exitf("restic binary path missing")
+// resticProfile is the profile whose repository the restic command uses.
+var resticProfile = resticFlags.String("profile", "", "Profile whose repository to use (required if multiple profiles are configured)")
+
+// runRestic implements the restic command. It exec's restic with the client
+// config and args.
+func runRestic(ctx context.Context, args []string) {
+	profiles, err := findProfiles(*resticProfile)
+	if err != nil {
+		log.Exitf("Failed to load profiles: %v", err)
+	}
+	if len(profiles) != 1 {
+		log.Exitf("Multiple profiles configured, --profile required")
 	}
+	p := profiles[0]
 
-	envv := os.Environ()
-	envv = append(envv, "RESTIC_REPOSITORY="+viper.GetString("restic.repository"))
-	envv = append(envv, "RESTIC_PASSWORD="+viper.GetString("restic.password"))
-	envv = append(envv, "GOOGLE_PROJECT_ID="+viper.GetString("google.project-number"))
-	envv = append(envv, "GOOGLE_APPLICATION_CREDENTIALS="+viper.GetString("google.credentials"))
+	r, err := newRestic(p.Restic)
+	if err != nil {
+		log.Exitf("Failed to create restic: %v", err)
+	}
 
-	execve(bin, pflag.Args(), envv)
+	argv, envv := r.Command(args)
+	execve(p.Restic.Binary, argv, envv)
 
 	log.Exitf("execve returned")
 }
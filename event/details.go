@@ -0,0 +1,103 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the current version of the Event schema. Events without a
+// version are version 1, which predates Details.
+const SchemaVersion = 2
+
+// VersionDetails are the Details of ClientVersion and ResticVersion events.
+type VersionDetails struct {
+	// Version is the version of the binary.
+	Version string
+}
+
+// UpdateDetails are the Details of UpdateComplete events.
+type UpdateDetails struct {
+	// FromClient and FromRestic are the versions before the update.
+	FromClient string
+	FromRestic string
+
+	// ToClient and ToRestic are the versions after the update.
+	ToClient string
+	ToRestic string
+}
+
+// BackupStartedDetails are the Details of BackupStarted events.
+type BackupStartedDetails struct {
+	// Paths are the paths being backed up, or a description of the
+	// stdin source.
+	Paths []string
+}
+
+// BackupSummary are the Details of BackupSucceeded events.
+type BackupSummary struct {
+	// SnapshotID is the ID of the snapshot created, if known.
+	SnapshotID string
+
+	// The statistics below are only available from restic 0.9.5+ with
+	// progress reporting enabled, and are otherwise 0.
+
+	// FilesNew and FilesChanged are the number of new and modified files.
+	FilesNew     int64
+	FilesChanged int64
+
+	// TotalFiles and TotalBytes are the files and bytes processed.
+	TotalFiles int64
+	TotalBytes int64
+
+	// DataAdded is the number of bytes added to the repository.
+	DataAdded int64
+
+	// Duration is how long the backup took.
+	Duration time.Duration
+}
+
+// NewDetails returns a pointer to the zero Details for events of type t, or
+// nil if t has no known Details.
+func NewDetails(t Type) interface{} {
+	switch t {
+	case ClientVersion, ResticVersion:
+		return &VersionDetails{}
+	case UpdateComplete:
+		return &UpdateDetails{}
+	case BackupStarted:
+		return &BackupStartedDetails{}
+	case BackupSucceeded:
+		return &BackupSummary{}
+	}
+	return nil
+}
+
+// SetDetails sets the Details of e to d, which should be of the type
+// returned by NewDetails(e.Type).
+func (e *Event) SetDetails(d interface{}) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("error encoding details %+v: %v", d, err)
+	}
+	e.Details = b
+	return nil
+}
+
+// DecodeDetails decodes the Details of e. It returns nil if e has no Details,
+// and the raw Details if e.Type has no known Details.
+func (e *Event) DecodeDetails() (interface{}, error) {
+	if len(e.Details) == 0 {
+		return nil, nil
+	}
+
+	d := NewDetails(e.Type)
+	if d == nil {
+		return e.Details, nil
+	}
+
+	if err := json.Unmarshal(e.Details, d); err != nil {
+		return nil, fmt.Errorf("malformed %s details %q: %v", e.Type, string(e.Details), err)
+	}
+	return d, nil
+}
@@ -2,6 +2,7 @@
 package event
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -22,6 +23,10 @@ const (
 	// client is restarting.
 	UpdateComplete Type = "update_complete"
 
+	// RepositoryInitialized indicates that a new repository was
+	// initialized because it did not exist.
+	RepositoryInitialized Type = "repository_initialized"
+
 	// BackupStarted indicates that a backup has begun.
 	BackupStarted Type = "backup_started"
 
@@ -30,10 +35,66 @@ const (
 
 	// BackupFailed indicates that a backup completed unsuccessfully.
 	BackupFailed Type = "backup_failed"
+
+	// BackupProgress reports the progress of a running backup.
+	BackupProgress Type = "backup_progress"
+
+	// BackupRetrying indicates that a backup attempt failed, and will be
+	// retried.
+	BackupRetrying Type = "backup_retrying"
+
+	// BackupSkipped indicates that a scheduled backup did not run. The
+	// message contains the reason.
+	BackupSkipped Type = "backup_skipped"
+
+	// BackupTimedOut indicates that a backup was interrupted because it
+	// exceeded its timeout.
+	BackupTimedOut Type = "backup_timed_out"
+
+	// StaleLockRemoved indicates that a repository lock left behind by a
+	// restic process that is no longer running was removed.
+	StaleLockRemoved Type = "stale_lock_removed"
+
+	// HookSucceeded indicates that a hook command run around a backup
+	// completed successfully. The message contains its output.
+	HookSucceeded Type = "hook_succeeded"
+
+	// HookFailed indicates that a hook command run around a backup failed.
+	// The message contains its output.
+	HookFailed Type = "hook_failed"
+
+	// ForgetSucceeded indicates that snapshots were successfully removed
+	// according to the retention policy.
+	ForgetSucceeded Type = "forget_succeeded"
+
+	// ForgetFailed indicates that removing snapshots according to the
+	// retention policy failed.
+	ForgetFailed Type = "forget_failed"
+)
+
+// Failure causes that are not otherwise classified by restic.Class.
+const (
+	// CauseTimeout indicates that the backup exceeded its timeout. It
+	// matches restic.ClassTimeout.
+	CauseTimeout = "timeout"
+
+	// CauseHook indicates that a pre-backup hook failed and aborted the
+	// backup.
+	CauseHook = "hook"
+
+	// CauseCommand indicates that a command providing stdin to a backup
+	// failed.
+	CauseCommand = "command"
+
+	// CauseConfig indicates that the backup is misconfigured.
+	CauseConfig = "config"
 )
 
 // Event describes a single event.
 type Event struct {
+	// Version is the schema version of the event, or 0 for version 1.
+	Version int
+
 	// Type is one of the above constants.
 	Type Type
 
@@ -43,6 +104,45 @@ type Event struct {
 	// Hostname is the machine on which the even occurred.
 	Hostname string
 
-	// Message is an optional free-form message.
+	// Profile is the backup profile to which the event applies, if any.
+	Profile string
+
+	// Cause classifies the failure described by a BackupFailed or
+	// BackupTimedOut event, so that failures can be grouped. It is a
+	// restic.Class, or one of the causes above.
+	Cause string
+
+	// Attempts is the number of backup attempts made, for events
+	// describing the outcome of a backup. For BackupRetrying events, it is
+	// the number of the failed attempt.
+	Attempts int
+
+	// Progress is the progress of the backup, for BackupProgress events.
+	Progress Progress
+
+	// Details are optional structured details, whose type depends on
+	// Type. See NewDetails.
+	Details json.RawMessage
+
+	// Message is an optional free-form message for humans.
 	Message string
 }
+
+// Progress is the progress of a running backup.
+type Progress struct {
+	// PercentDone is the fraction of the backup completed, from 0 to 1.
+	PercentDone float64
+
+	// BytesDone and TotalBytes are the bytes processed and the total
+	// bytes to process.
+	BytesDone  int64
+	TotalBytes int64
+
+	// FilesDone and TotalFiles are the files processed and the total
+	// files to process.
+	FilesDone  int64
+	TotalFiles int64
+
+	// ETA is the estimated remaining time, or 0 if unknown.
+	ETA time.Duration
+}
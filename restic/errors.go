@@ -0,0 +1,188 @@
+package restic
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Class classifies the cause of a restic failure.
+type Class string
+
+const (
+	// ClassUnknown is a failure that could not be classified.
+	ClassUnknown Class = "unknown"
+
+	// ClassWrongPassword indicates that the repository password is wrong.
+	ClassWrongPassword Class = "wrong_password"
+
+	// ClassRepositoryNotFound indicates that the repository does not
+	// exist.
+	ClassRepositoryNotFound Class = "repository_not_found"
+
+	// ClassLocked indicates that the repository is locked by another
+	// process.
+	ClassLocked Class = "locked"
+
+	// ClassBackend indicates a network or storage backend error.
+	ClassBackend Class = "backend"
+
+	// ClassPartial indicates that a snapshot was created, but some source
+	// files could not be read.
+	ClassPartial Class = "partial"
+
+	// ClassNoSpace indicates that a disk (usually the local cache) is
+	// full.
+	ClassNoSpace Class = "no_space"
+
+	// ClassTimeout indicates that restic exceeded its configured timeout.
+	ClassTimeout Class = "timeout"
+
+	// ClassCancelled indicates that restic was interrupted because the
+	// operation was cancelled.
+	ClassCancelled Class = "cancelled"
+)
+
+// Retryable returns true if failures of class c are likely transient, and
+// may succeed if retried.
+func (c Class) Retryable() bool {
+	switch c {
+	case ClassLocked, ClassBackend, ClassTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// restic exit statuses.
+const (
+	// exitPartial indicates that the snapshot is incomplete.
+	exitPartial = 3
+
+	// exitNotFound indicates that the repository does not exist.
+	exitNotFound = 10
+
+	// exitLocked indicates that the repository could not be locked.
+	exitLocked = 11
+
+	// exitWrongPassword indicates that the password is wrong.
+	exitWrongPassword = 12
+)
+
+// statusClasses maps restic exit statuses to classes. Older versions of
+// restic only use exit status 1, so stderr is also checked.
+var statusClasses = map[int]Class{
+	exitPartial:       ClassPartial,
+	exitNotFound:      ClassRepositoryNotFound,
+	exitLocked:        ClassLocked,
+	exitWrongPassword: ClassWrongPassword,
+}
+
+// notFoundRE matches restic's explicit report that the repository does not
+// exist.
+//
+// restic also prints "Is there a repository at the following location?"
+// after any failure to open the config file, including backend and
+// permission errors, so that line does not show the repository is missing.
+var notFoundRE = regexp.MustCompile(`(?i)repository does not exist|config file does not exist`)
+
+// stderrClasses are patterns of restic stderr output for each class, in
+// order of precedence.
+var stderrClasses = []struct {
+	class Class
+	re    *regexp.Regexp
+}{
+	{ClassWrongPassword, regexp.MustCompile(`wrong password or no key found`)},
+	{ClassLocked, regexp.MustCompile(`(?i)repository is already locked`)},
+	{ClassNoSpace, regexp.MustCompile(`(?i)no space left on device|disk quota exceeded|not enough space`)},
+	{ClassBackend, regexp.MustCompile(`(?i)connection refused|connection reset|no such host|network is unreachable|i/o timeout|TLS handshake timeout|dial tcp|googleapi: Error 5\d\d|unexpected EOF|server misbehaving`)},
+	{ClassRepositoryNotFound, notFoundRE},
+}
+
+// Error is returned when a restic command fails.
+type Error struct {
+	// Command is the restic command that failed (e.g., "backup").
+	Command string
+
+	// Class is the cause of the failure.
+	Class Class
+
+	// Status is the exit status of restic, or -1 if restic did not exit
+	// normally (e.g., it could not be started or was killed).
+	Status int
+
+	// Stderr is the stderr output of restic.
+	Stderr string
+
+	// Err is the error from running restic.
+	Err error
+}
+
+// Error implements error.Error.
+//
+// It includes the last line of stderr, which usually describes the failure.
+func (e *Error) Error() string {
+	s := fmt.Sprintf("'restic %s' failed (%s) with error %v", e.Command, e.Class, e.Err)
+
+	lines := strings.Split(strings.TrimSpace(e.Stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		s += ": " + last
+	}
+	return s
+}
+
+// ClassOf returns the class of err, or ClassUnknown if err is not an *Error.
+func ClassOf(err error) Class {
+	if e, ok := err.(*Error); ok {
+		return e.Class
+	}
+	return ClassUnknown
+}
+
+// newError returns an *Error for err returned by running command with
+// context ctx. timeout is the timeout applied to ctx, if any.
+func newError(ctx context.Context, command string, timeout time.Duration, err error, stderr string) *Error {
+	e := &Error{
+		Command: command,
+		Class:   ClassUnknown,
+		Status:  -1,
+		Stderr:  stderr,
+		Err:     err,
+	}
+
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			e.Status = ws.ExitStatus()
+		}
+	}
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		e.Class = ClassTimeout
+		if timeout != 0 {
+			e.Err = fmt.Errorf("timed out after %v: %v", timeout, err)
+		}
+		return e
+	case context.Canceled:
+		e.Class = ClassCancelled
+		return e
+	}
+
+	if c, ok := statusClasses[e.Status]; ok {
+		e.Class = c
+		return e
+	}
+
+	for _, sc := range stderrClasses {
+		if sc.re.MatchString(stderr) {
+			e.Class = sc.class
+			return e
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,10 @@
+package restic
+
+import (
+	"os"
+)
+
+// interrupt asks p to exit cleanly.
+func interrupt(p *os.Process) error {
+	return p.Signal(os.Interrupt)
+}
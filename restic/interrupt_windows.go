@@ -0,0 +1,13 @@
+package restic
+
+import (
+	"os"
+)
+
+// interrupt asks p to exit cleanly.
+//
+// Windows cannot deliver an interrupt to another process, so p is killed
+// immediately.
+func interrupt(p *os.Process) error {
+	return p.Kill()
+}
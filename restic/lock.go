@@ -0,0 +1,78 @@
+package restic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lock describes a restic repository lock.
+type Lock struct {
+	// ID is the ID of the lock in the repository.
+	ID string `json:"-"`
+
+	// Time is the time the lock was created or last refreshed.
+	Time time.Time `json:"time"`
+
+	// Exclusive indicates that the lock is exclusive.
+	Exclusive bool `json:"exclusive"`
+
+	// Hostname is the system hostname of the machine holding the lock.
+	// This is not necessarily Config.Hostname.
+	Hostname string `json:"hostname"`
+
+	// Username is the user holding the lock.
+	Username string `json:"username"`
+
+	// PID is the ID of the restic process holding the lock.
+	PID int `json:"pid"`
+}
+
+// Locks returns all of the locks in the repository.
+func (r *Restic) Locks(ctx context.Context) ([]Lock, error) {
+	so, _, err := r.run(ctx, r.config.Timeouts.Locks, nil, nil, "list", "locks", "--no-lock")
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []Lock
+	for _, id := range strings.Fields(so) {
+		l, err := r.lock(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, *l)
+	}
+
+	return locks, nil
+}
+
+// lock returns the lock with the given ID.
+func (r *Restic) lock(ctx context.Context, id string) (*Lock, error) {
+	so, _, err := r.run(ctx, r.config.Timeouts.Locks, nil, nil, "cat", "lock", id, "--no-lock", "--json")
+	if err != nil {
+		return nil, err
+	}
+
+	l := Lock{ID: id}
+	if err := json.Unmarshal([]byte(so), &l); err != nil {
+		return nil, fmt.Errorf("error decoding lock %s %q: %v", id, so, err)
+	}
+
+	return &l, nil
+}
+
+// UnlockAge is the age after which Unlock removes a lock, whichever machine
+// created it.
+const UnlockAge = 30 * time.Minute
+
+// Unlock removes stale locks from the repository.
+//
+// restic considers a lock stale if it is more than UnlockAge old, or if it
+// was created on this machine by a process that is no longer running.
+func (r *Restic) Unlock(ctx context.Context) error {
+	_, _, err := r.run(ctx, r.config.Timeouts.Locks, nil, nil, "unlock")
+	return err
+}
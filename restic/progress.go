@@ -0,0 +1,104 @@
+package restic
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Progress is the progress of a running backup, as reported by restic's JSON
+// status messages.
+type Progress struct {
+	// PercentDone is the fraction of the backup completed, from 0 to 1.
+	PercentDone float64
+
+	// BytesDone and TotalBytes are the bytes processed and the total
+	// bytes to process. TotalBytes may grow while restic scans.
+	BytesDone  uint64
+	TotalBytes uint64
+
+	// FilesDone and TotalFiles are the files processed and the total
+	// files to process. TotalFiles may grow while restic scans.
+	FilesDone  uint64
+	TotalFiles uint64
+
+	// Elapsed is the time since the backup started.
+	Elapsed time.Duration
+
+	// ETA is restic's estimate of the remaining time, or 0 if unknown.
+	ETA time.Duration
+}
+
+// ProgressFunc receives backup progress updates. It is called from the
+// goroutine reading restic's output, so it should not block.
+type ProgressFunc func(Progress)
+
+// statusMessage is a restic 'backup --json' status line.
+type statusMessage struct {
+	MessageType      string  `json:"message_type"`
+	PercentDone      float64 `json:"percent_done"`
+	TotalFiles       uint64  `json:"total_files"`
+	FilesDone        uint64  `json:"files_done"`
+	TotalBytes       uint64  `json:"total_bytes"`
+	BytesDone        uint64  `json:"bytes_done"`
+	SecondsElapsed   uint64  `json:"seconds_elapsed"`
+	SecondsRemaining uint64  `json:"seconds_remaining"`
+}
+
+// progressWriter splits restic 'backup --json' output into lines, passing
+// status lines to f and writing all other lines to w.
+type progressWriter struct {
+	w    io.Writer
+	f    ProgressFunc
+	line []byte
+}
+
+// Write implements io.Writer.Write.
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.line = append(p.line, b...)
+			break
+		}
+		p.line = append(p.line, b[:i+1]...)
+		b = b[i+1:]
+		if err := p.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// flush handles the buffered line.
+func (p *progressWriter) flush() error {
+	line := p.line
+	p.line = p.line[:0]
+
+	var m statusMessage
+	if json.Unmarshal(line, &m) == nil && m.MessageType == "status" {
+		p.f(Progress{
+			PercentDone: m.PercentDone,
+			BytesDone:   m.BytesDone,
+			TotalBytes:  m.TotalBytes,
+			FilesDone:   m.FilesDone,
+			TotalFiles:  m.TotalFiles,
+			Elapsed:     time.Duration(m.SecondsElapsed) * time.Second,
+			ETA:         time.Duration(m.SecondsRemaining) * time.Second,
+		})
+		return nil
+	}
+
+	_, err := p.w.Write(line)
+	return err
+}
+
+// Close writes any incomplete final line.
+func (p *progressWriter) Close() error {
+	if len(p.line) == 0 {
+		return nil
+	}
+	return p.flush()
+}
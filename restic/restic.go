@@ -3,10 +3,16 @@ package restic
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/prattmic/restic-remote/binver"
 	"github.com/prattmic/restic-remote/log"
@@ -22,9 +28,18 @@ type Config struct {
 	// https://restic.readthedocs.io/en/latest/manual.html#initialize-a-repository
 	Repository string
 
-	// Password is the repository password.
+	// Password is the repository password. It is passed to restic in the
+	// environment. It is ignored if PasswordFile or PasswordCommand is set.
 	Password string
 
+	// PasswordFile is the path to a file containing the repository
+	// password, passed via RESTIC_PASSWORD_FILE.
+	PasswordFile string `mapstructure:"-"`
+
+	// PasswordCommand is a command printing the repository password,
+	// passed via '--password-command'. It requires restic 0.9.6 or later.
+	PasswordCommand string `mapstructure:"-"`
+
 	// Hostname is the hostname to use for this machine when performing
 	// backups.
 	Hostname string
@@ -44,6 +59,127 @@ type Config struct {
 	// BackendOptions are optional options for the repository backend. They
 	// are passed via '-o'.
 	BackendOptions map[string]string
+
+	// Exclude are patterns of files and directories to exclude from
+	// backups. They are passed via '--exclude'.
+	Exclude []string
+
+	// ExcludeFile are paths to files containing exclude patterns, one per
+	// line. They are passed via '--exclude-file'.
+	ExcludeFile []string `mapstructure:"exclude-file"`
+
+	// ExcludeCaches excludes directories containing a CACHEDIR.TAG file.
+	ExcludeCaches bool `mapstructure:"exclude-caches"`
+
+	// ExcludeIfPresent excludes directories containing any of these
+	// filenames.
+	ExcludeIfPresent []string `mapstructure:"exclude-if-present"`
+
+	// ExcludeLargerThan excludes files larger than this size, in the format
+	// accepted by restic (e.g., "500M"). Empty has no limit.
+	ExcludeLargerThan string `mapstructure:"exclude-larger-than"`
+
+	// OneFileSystem prevents backups from crossing filesystem boundaries.
+	OneFileSystem bool `mapstructure:"one-file-system"`
+
+	// Tags are added to every snapshot created by backups, and limit
+	// which snapshots are considered by Forget.
+	Tags []string
+
+	// Timeouts are the maximum durations of restic operations.
+	Timeouts Timeouts
+
+	// AutoInit indicates that the repository should be initialized with
+	// Init if RepositoryExists reports that it does not exist. It is
+	// acted on by callers, not by this package.
+	AutoInit bool `mapstructure:"auto-init"`
+}
+
+// Timeouts are the maximum durations of restic operations. 0 is unlimited.
+type Timeouts struct {
+	// Backup limits Backup and BackupStdin.
+	Backup time.Duration
+
+	// Forget limits Forget and ForgetSnapshot.
+	Forget time.Duration
+
+	// Snapshots limits Snapshots.
+	Snapshots time.Duration
+
+	// Locks limits Locks and Unlock.
+	Locks time.Duration
+
+	// Init limits Init and RepositoryExists.
+	Init time.Duration
+
+	// Restore limits Restore.
+	Restore time.Duration
+
+	// Check limits Check.
+	Check time.Duration
+}
+
+// Retention describes which snapshots to keep when forgetting old snapshots.
+//
+// See https://restic.readthedocs.io/en/latest/manual.html#removing-snapshots-according-to-a-policy.
+// Zero values are ignored.
+type Retention struct {
+	// KeepLast keeps the last n snapshots.
+	KeepLast int `mapstructure:"keep-last"`
+
+	// KeepHourly keeps the last n hourly snapshots.
+	KeepHourly int `mapstructure:"keep-hourly"`
+
+	// KeepDaily keeps the last n daily snapshots.
+	KeepDaily int `mapstructure:"keep-daily"`
+
+	// KeepWeekly keeps the last n weekly snapshots.
+	KeepWeekly int `mapstructure:"keep-weekly"`
+
+	// KeepMonthly keeps the last n monthly snapshots.
+	KeepMonthly int `mapstructure:"keep-monthly"`
+
+	// KeepYearly keeps the last n yearly snapshots.
+	KeepYearly int `mapstructure:"keep-yearly"`
+
+	// KeepWithin keeps all snapshots within this duration of the latest
+	// snapshot, in the format accepted by restic (e.g., "2y5m7d").
+	KeepWithin string `mapstructure:"keep-within"`
+
+	// Prune removes data no longer referenced by any snapshot after
+	// forgetting snapshots.
+	Prune bool
+}
+
+// args returns the 'restic forget' arguments for the policy, or nil if the
+// policy keeps everything.
+func (p Retention) args() []string {
+	var args []string
+	keep := []struct {
+		flag string
+		n    int
+	}{
+		{"--keep-last", p.KeepLast},
+		{"--keep-hourly", p.KeepHourly},
+		{"--keep-daily", p.KeepDaily},
+		{"--keep-weekly", p.KeepWeekly},
+		{"--keep-monthly", p.KeepMonthly},
+		{"--keep-yearly", p.KeepYearly},
+	}
+	for _, k := range keep {
+		if k.n > 0 {
+			args = append(args, k.flag, strconv.Itoa(k.n))
+		}
+	}
+	if p.KeepWithin != "" {
+		args = append(args, "--keep-within", p.KeepWithin)
+	}
+	return args
+}
+
+// Empty returns true if the policy keeps all snapshots.
+func (p Retention) Empty() bool {
+	return len(p.args()) == 0
 }
 
 // Restic provides an interface to the restic binary.
@@ -59,7 +195,7 @@ func New(c Config) (*Restic, error) {
 	if c.Repository == "" {
 		return nil, fmt.Errorf("restic repository must be provided")
 	}
-	if c.Password == "" {
+	if c.Password == "" && c.PasswordFile == "" && c.PasswordCommand == "" {
 		return nil, fmt.Errorf("restic password must be provided")
 	}
 	if c.Hostname == "" {
@@ -71,11 +207,13 @@ func New(c Config) (*Restic, error) {
 	}, nil
 }
 
-// run runs restic with args, returning stdout and stderr.
-//
-// The repository, password, hostname, and backend options are all added to the
-// environment.
-func (r *Restic) run(args ...string) (string, string, error) {
+// interruptGrace is how long restic has to exit after it is interrupted
+// before it is killed. This gives restic a chance to remove its lock.
+const interruptGrace = 30 * time.Second
+
+// globalArgs returns the restic global flags for the config.
+func (r *Restic) globalArgs() []string {
+	var args []string
 	if r.config.LimitUpload != 0 {
 		args = append(args, "--limit-upload", strconv.FormatUint(r.config.LimitUpload, 10))
 	}
@@ -87,51 +225,379 @@ func (r *Restic) run(args ...string) (string, string, error) {
 		args = append(args, "-o", k+"="+v)
 	}
 
-	log.Infof("Running %s %v", r.config.Binary, args)
+	if r.config.PasswordFile == "" && r.config.PasswordCommand != "" {
+		args = append(args, "--password-command", r.config.PasswordCommand)
+	}
 
-	c := exec.Command(r.config.Binary, args...)
-	c.Env = os.Environ()
-	c.Env = append(c.Env, "RESTIC_REPOSITORY="+r.config.Repository)
-	c.Env = append(c.Env, "RESTIC_PASSWORD="+r.config.Password)
+	return args
+}
+
+// environ returns the environment for restic: the current environment plus
+// the repository, password, and backend environment.
+func (r *Restic) environ() []string {
+	env := os.Environ()
+	env = append(env, "RESTIC_REPOSITORY="+r.config.Repository)
+	switch {
+	case r.config.PasswordFile != "":
+		env = append(env, "RESTIC_PASSWORD_FILE="+r.config.PasswordFile)
+	case r.config.PasswordCommand != "":
+	default:
+		env = append(env, "RESTIC_PASSWORD="+r.config.Password)
+	}
 	for k, v := range r.config.BackendEnv {
-		c.Env = append(c.Env, k+"="+v)
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// Command returns the arguments and environment to run restic with args
+// directly, for example to exec it. The configured global flags precede args.
+func (r *Restic) Command(args []string) ([]string, []string) {
+	return append(r.globalArgs(), args...), r.environ()
+}
+
+// run runs restic with args, returning stdout and stderr. If in is non-nil,
+// restic reads stdin from it.
+//
+// If progress is non-nil, restic must be run with '--json'. Status lines are
+// passed to progress rather than returned in stdout.
+//
+// The repository, password, hostname, and backend options are all added to the
+// environment.
+//
+// If ctx is cancelled or timeout (if non-zero) expires, restic is
+// interrupted, and killed if it does not exit within interruptGrace. Failures
+// are returned as *Error.
+func (r *Restic) run(ctx context.Context, timeout time.Duration, in io.Reader, progress ProgressFunc, args ...string) (string, string, error) {
+	command := args[0]
+
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
+	args = append(args, r.globalArgs()...)
+
+	log.Infof("Running %s %v", r.config.Binary, args)
+
+	c := exec.Command(r.config.Binary, args...)
+	c.Env = r.environ()
+
 	var so, se bytes.Buffer
+	c.Stdin = in
 	c.Stdout = &so
 	c.Stderr = &se
+	var pw *progressWriter
+	if progress != nil {
+		pw = &progressWriter{w: &so, f: progress}
+		c.Stdout = pw
+	}
+
+	if err := c.Start(); err != nil {
+		return "", "", newError(ctx, command, timeout, err, "")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+
+		log.Warningf("Interrupting 'restic %s': %v", command, ctx.Err())
+		if err := interrupt(c.Process); err != nil {
+			log.Warningf("Failed to interrupt restic: %v", err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(interruptGrace):
+			log.Warningf("'restic %s' did not exit after interrupt, killing", command)
+			c.Process.Kill()
+		}
+	}()
 
-	err := c.Run()
-	return so.String(), se.String(), err
+	err := c.Wait()
+	close(done)
+	if pw != nil {
+		pw.Close()
+	}
+
+	if err != nil {
+		return so.String(), se.String(), newError(ctx, command, timeout, err, se.String())
+	}
+
+	return so.String(), se.String(), nil
 }
 
 // Version returns the complete restic version string.
-func (r *Restic) Version() (string, error) {
-	return binver.Restic(r.config.Binary)
+func (r *Restic) Version(ctx context.Context) (string, error) {
+	return binver.Restic(ctx, r.config.Binary)
 }
 
 // Snapshots returns the all restic snapshots. It does no parsing.
-func (r *Restic) Snapshots() (string, error) {
-	so, se, err := r.run("snapshots", "--host", r.config.Hostname)
+func (r *Restic) Snapshots(ctx context.Context) (string, error) {
+	so, _, err := r.run(ctx, r.config.Timeouts.Snapshots, nil, nil, "snapshots", "--host", r.config.Hostname)
+	if err != nil {
+		return "", err
+	}
+
+	return so, nil
+}
+
+// Restore restores snapshot id (or "latest") to target. If include is
+// non-empty, only matching files are restored.
+//
+// It returns stdout from restic.
+func (r *Restic) Restore(ctx context.Context, id, target string, include []string) (string, error) {
+	var args []string
+	args = append(args, "restore", id, "--target", target)
+	if id == "latest" {
+		// Only consider our own snapshots for "latest", with all of
+		// the configured tags, as for Forget.
+		args = append(args, "--host", r.config.Hostname)
+		if len(r.config.Tags) > 0 {
+			args = append(args, "--tag", strings.Join(r.config.Tags, ","))
+		}
+	}
+	for _, i := range include {
+		args = append(args, "--include", i)
+	}
+
+	so, _, err := r.run(ctx, r.config.Timeouts.Restore, nil, nil, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return so, nil
+}
+
+// Check checks the repository for errors. If readData is set, all pack files
+// are read and verified, which may take a long time.
+//
+// It returns stdout from restic.
+func (r *Restic) Check(ctx context.Context, readData bool) (string, error) {
+	args := []string{"check"}
+	if readData {
+		args = append(args, "--read-data")
+	}
+
+	so, _, err := r.run(ctx, r.config.Timeouts.Check, nil, nil, args...)
 	if err != nil {
-		return "", fmt.Errorf("'restic snapshot' failed with error %v. stderr: %s", err, se)
+		return "", err
 	}
 
 	return so, nil
 }
 
-// Backup creates a new snapshot of dirs.
+// excludeArgs returns the backup arguments for the configured exclusions.
+func (r *Restic) excludeArgs() []string {
+	var args []string
+	for _, e := range r.config.Exclude {
+		args = append(args, "--exclude", e)
+	}
+	for _, f := range r.config.ExcludeFile {
+		args = append(args, "--exclude-file", f)
+	}
+	if r.config.ExcludeCaches {
+		args = append(args, "--exclude-caches")
+	}
+	for _, f := range r.config.ExcludeIfPresent {
+		args = append(args, "--exclude-if-present", f)
+	}
+	if r.config.ExcludeLargerThan != "" {
+		args = append(args, "--exclude-larger-than", r.config.ExcludeLargerThan)
+	}
+	if r.config.OneFileSystem {
+		args = append(args, "--one-file-system")
+	}
+	return args
+}
+
+// Backup creates a new snapshot of dirs, skipping any configured exclusions.
+//
+// If progress is non-nil, it receives progress updates as the backup runs.
+// This requires a restic version supporting 'backup --json'.
 //
 // It returns stdout and stderr from restic.
-func (r *Restic) Backup(dirs []string) (string, string, error) {
+func (r *Restic) Backup(ctx context.Context, dirs []string, progress ProgressFunc) (string, string, error) {
 	var args []string
 	args = append(args, "backup", "--hostname", r.config.Hostname)
+	if progress != nil {
+		args = append(args, "--json")
+	}
+	args = append(args, r.excludeArgs()...)
+	for _, t := range r.config.Tags {
+		args = append(args, "--tag", t)
+	}
 	args = append(args, dirs...)
 
-	so, se, err := r.run(args...)
+	return r.run(ctx, r.config.Timeouts.Backup, nil, progress, args...)
+}
+
+// BackupStdin creates a new snapshot containing a single file, filename,
+// with the contents read from in.
+//
+// progress is as for Backup.
+//
+// It returns stdout and stderr from restic.
+func (r *Restic) BackupStdin(ctx context.Context, filename string, in io.Reader, progress ProgressFunc) (string, string, error) {
+	var args []string
+	args = append(args, "backup", "--hostname", r.config.Hostname)
+	if progress != nil {
+		args = append(args, "--json")
+	}
+	args = append(args, "--stdin", "--stdin-filename", filename)
+	for _, t := range r.config.Tags {
+		args = append(args, "--tag", t)
+	}
+
+	return r.run(ctx, r.config.Timeouts.Backup, in, progress, args...)
+}
+
+// snapshotRE matches the line printed by 'restic backup' when the snapshot
+// is saved, or the snapshot ID in the 'restic backup --json' summary.
+var snapshotRE = regexp.MustCompile(`(?m)^snapshot ([0-9a-f]+) saved|"snapshot_id":\s*"([0-9a-f]+)"`)
+
+// SnapshotID returns the ID of the snapshot created by 'restic backup', given
+// its stdout. It returns "" if no snapshot was saved.
+func SnapshotID(stdout string) string {
+	m := snapshotRE.FindStringSubmatch(stdout)
+	if m == nil {
+		return ""
+	}
+	if m[1] != "" {
+		return m[1]
+	}
+	return m[2]
+}
+
+// summaryRE matches the summary line printed by 'restic backup'.
+var summaryRE = regexp.MustCompile(`(?m)^processed .*$`)
+
+// jsonSummary is the final line printed by 'restic backup --json'.
+type jsonSummary struct {
+	MessageType         string  `json:"message_type"`
+	FilesNew            uint64  `json:"files_new"`
+	FilesChanged        uint64  `json:"files_changed"`
+	TotalFilesProcessed uint64  `json:"total_files_processed"`
+	TotalBytesProcessed uint64  `json:"total_bytes_processed"`
+	DataAdded           uint64  `json:"data_added"`
+	TotalDuration       float64 `json:"total_duration"`
+}
+
+// parseSummary returns the JSON summary in stdout, or nil if there is none.
+func parseSummary(stdout string) *jsonSummary {
+	for _, line := range strings.Split(stdout, "\n") {
+		var s jsonSummary
+		if json.Unmarshal([]byte(line), &s) == nil && s.MessageType == "summary" {
+			return &s
+		}
+	}
+	return nil
+}
+
+// Summary returns a one-line summary of a 'restic backup', given its stdout.
+// It returns "" if restic printed no summary.
+func Summary(stdout string) string {
+	if s := parseSummary(stdout); s != nil {
+		return fmt.Sprintf("processed %d files (%d new, %d changed), %d bytes in %v; added %d bytes",
+			s.TotalFilesProcessed, s.FilesNew, s.FilesChanged, s.TotalBytesProcessed,
+			time.Duration(s.TotalDuration*float64(time.Second)).Round(time.Second), s.DataAdded)
+	}
+
+	return summaryRE.FindString(stdout)
+}
+
+// Stats are the statistics of a 'restic backup'.
+type Stats struct {
+	// FilesNew and FilesChanged are the number of new and modified files.
+	FilesNew     uint64
+	FilesChanged uint64
+
+	// TotalFiles and TotalBytes are the files and bytes processed.
+	TotalFiles uint64
+	TotalBytes uint64
+
+	// DataAdded is the number of bytes added to the repository.
+	DataAdded uint64
+
+	// Duration is how long the backup took.
+	Duration time.Duration
+}
+
+// BackupStats returns the statistics of a 'restic backup --json', given its
+// stdout. It returns false if restic printed no JSON summary.
+func BackupStats(stdout string) (Stats, bool) {
+	s := parseSummary(stdout)
+	if s == nil {
+		return Stats{}, false
+	}
+	return Stats{
+		FilesNew:     s.FilesNew,
+		FilesChanged: s.FilesChanged,
+		TotalFiles:   s.TotalFilesProcessed,
+		TotalBytes:   s.TotalBytesProcessed,
+		DataAdded:    s.DataAdded,
+		Duration:     time.Duration(s.TotalDuration * float64(time.Second)),
+	}, true
+}
+
+// Forget removes snapshots from this host that are not kept by policy p.
+//
+// Only snapshots with all of the configured tags are considered. It returns
+// stdout from restic.
+func (r *Restic) Forget(ctx context.Context, p Retention) (string, error) {
+	if p.Empty() {
+		return "", fmt.Errorf("retention policy %+v would remove all snapshots", p)
+	}
+
+	var args []string
+	args = append(args, "forget", "--host", r.config.Hostname)
+	if len(r.config.Tags) > 0 {
+		args = append(args, "--tag", strings.Join(r.config.Tags, ","))
+	}
+	args = append(args, p.args()...)
+	if p.Prune {
+		args = append(args, "--prune")
+	}
+
+	so, _, err := r.run(ctx, r.config.Timeouts.Forget, nil, nil, args...)
 	if err != nil {
-		return so, se, fmt.Errorf("'restic backup' failed with error %v", err)
+		return so, err
+	}
+
+	return so, nil
+}
+
+// ForgetSnapshot removes the snapshot with the given ID.
+func (r *Restic) ForgetSnapshot(ctx context.Context, id string) error {
+	_, _, err := r.run(ctx, r.config.Timeouts.Forget, nil, nil, "forget", id)
+	return err
+}
+
+// RepositoryExists returns true if the repository exists.
+//
+// It returns an error if existence could not be determined, for example
+// because the backend is unreachable or the password is wrong.
+func (r *Restic) RepositoryExists(ctx context.Context) (bool, error) {
+	_, _, err := r.run(ctx, r.config.Timeouts.Init, nil, nil, "cat", "config", "--no-lock")
+	if err == nil {
+		return true, nil
+	}
+	// Only restic's explicit report counts, so that a repository is never
+	// initialized because it could not be reached.
+	if e, ok := err.(*Error); ok && (e.Status == exitNotFound || notFoundRE.MatchString(e.Stderr)) {
+		return false, nil
 	}
 
-	return so, se, nil
+	return false, err
+}
+
+// Init initializes a new repository.
+func (r *Restic) Init(ctx context.Context) (string, error) {
+	so, _, err := r.run(ctx, r.config.Timeouts.Init, nil, nil, "init")
+	return so, err
 }
@@ -1,17 +1,66 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 
+	"github.com/prattmic/restic-remote/api"
 	"github.com/prattmic/restic-remote/event"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
 
+// eventEntity is an event as stored in datastore.
+type eventEntity struct {
+	// Event is the event sent by the client.
+	event.Event
+
+	// Subject is the subject of the access token that wrote the event.
+	Subject string
+}
+
+// newEventEntity returns the entity to store for event e written by r. If r
+// may not write e, it returns nil and the HTTP status and message to respond
+// with.
+func newEventEntity(r *http.Request, e *event.Event) (*eventEntity, int, string) {
+	// Check the details of types we know. Details of unknown types, or
+	// from newer schema versions, are stored verbatim.
+	if e.Version <= event.SchemaVersion {
+		if _, err := e.DecodeDetails(); err != nil {
+			log.Printf("Rejecting event: %v", err)
+			return nil, http.StatusBadRequest, "Malformed details"
+		}
+	}
+
+	entity := &eventEntity{
+		Event: *e,
+	}
+
+	// Hosts may only write their own events.
+	if id, ok := requestIdentity(r); ok {
+		entity.Subject = id.Subject
+
+		switch {
+		case id.Hostname == "" && hostnamePolicy == policyRequire:
+			log.Printf("Rejecting event for %q from %s, which is not bound to a host", e.Hostname, id.Subject)
+			return nil, http.StatusForbidden, "Credentials not bound to a host"
+		case id.Hostname == "":
+			// Not bound to a host; trust the event.
+		case hostnamePolicy == policyOverwrite:
+			entity.Hostname = id.Hostname
+		case e.Hostname != id.Hostname:
+			log.Printf("Rejecting event for %q from %s for %q", e.Hostname, id.Subject, id.Hostname)
+			return nil, http.StatusForbidden, "Hostname does not match credentials"
+		}
+	}
+
+	return entity, 0, ""
+}
+
 func writeEvent(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 
@@ -37,9 +86,22 @@ func writeEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	entity, code, msg := newEventEntity(r, &e)
+	if entity == nil {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "%s", msg)
+		return
+	}
+
+	idem := r.Header.Get(api.IdempotencyHeader)
+	if idem != "" && !validIdempotencyKey(idem) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Malformed %s", api.IdempotencyHeader)
+		return
+	}
+
 	// Stash the event in datastore.
-	key := datastore.NewIncompleteKey(ctx, "Event", nil)
-	if _, err := datastore.Put(ctx, key, &e); err != nil {
+	if err := storeEvent(ctx, idem, entity); err != nil {
 		log.Printf("Failed to store event: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Internal Server Error")
@@ -48,3 +110,61 @@ func writeEvent(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Fprintf(w, "Thanks!")
 }
+
+// maxIdempotencyKeyLen is the maximum length of an idempotency key.
+const maxIdempotencyKeyLen = 64
+
+// validIdempotencyKey returns true if k is an acceptable idempotency key.
+func validIdempotencyKey(k string) bool {
+	if len(k) > maxIdempotencyKeyLen {
+		return false
+	}
+	for _, c := range k {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// eventKey returns the datastore key of event e with idempotency key idem, or
+// an incomplete key if idem is empty.
+//
+// Idempotency keys are chosen by clients, so the key name includes the
+// subject and hostname of the event. Otherwise a client could choose the keys
+// of another client's events, causing them to be dropped as duplicates.
+func eventKey(ctx context.Context, idem string, e *eventEntity) *datastore.Key {
+	if idem == "" {
+		return datastore.NewIncompleteKey(ctx, "Event", nil)
+	}
+	name := fmt.Sprintf("%s %s %s", e.Subject, e.Hostname, idem)
+	return datastore.NewKey(ctx, "Event", name, 0, nil)
+}
+
+// storeEvent stores e in datastore. If idem is not empty, it is the event
+// idempotency key, and the event is stored only if no event with that key
+// exists, so that retried requests are not duplicated.
+func storeEvent(ctx context.Context, idem string, e *eventEntity) error {
+	key := eventKey(ctx, idem, e)
+	if idem == "" {
+		_, err := datastore.Put(ctx, key, e)
+		return err
+	}
+
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var existing eventEntity
+		err := datastore.Get(ctx, key, &existing)
+		if err == nil || isFieldMismatch(err) {
+			// Already stored by an earlier attempt.
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return fmt.Errorf("error getting event %q: %v", idem, err)
+		}
+
+		_, err = datastore.Put(ctx, key, e)
+		return err
+	}, nil)
+}
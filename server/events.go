@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/prattmic/restic-remote/api"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// writeEvents stores a batch of events, responding with the status of each.
+func writeEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Only POST requests allowed")
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Failed to read body: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal Server Error")
+		return
+	}
+
+	var batch []api.BatchEvent
+	if err := json.Unmarshal(b, &batch); err != nil {
+		log.Printf("Failed to decode events %q: %v", string(b), err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Malformed events")
+		return
+	}
+
+	if len(batch) > api.MaxBatchEvents {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "At most %d events allowed", api.MaxBatchEvents)
+		return
+	}
+
+	statuses := make([]api.EventStatus, len(batch))
+	var (
+		keys     []*datastore.Key
+		entities []*eventEntity
+		// index are the indices in batch of keys and entities.
+		index []int
+	)
+	for i := range batch {
+		be := &batch[i]
+
+		if be.IdempotencyKey != "" && !validIdempotencyKey(be.IdempotencyKey) {
+			statuses[i] = api.EventStatus{
+				Status: http.StatusBadRequest,
+				Error:  "Malformed IdempotencyKey",
+			}
+			continue
+		}
+
+		entity, code, msg := newEventEntity(r, &be.Event)
+		if entity == nil {
+			statuses[i] = api.EventStatus{
+				Status: code,
+				Error:  msg,
+			}
+			continue
+		}
+
+		keys = append(keys, eventKey(ctx, be.IdempotencyKey, entity))
+		entities = append(entities, entity)
+		index = append(index, i)
+	}
+
+	keys, entities, index = skipStored(ctx, keys, entities, index, statuses)
+
+	if len(keys) > 0 {
+		_, err := datastore.PutMulti(ctx, keys, entities)
+		merr, multi := err.(appengine.MultiError)
+		for j, i := range index {
+			var perr error
+			if multi {
+				perr = merr[j]
+			} else {
+				perr = err
+			}
+
+			if perr != nil {
+				log.Printf("Failed to store event: %v", perr)
+				statuses[i] = api.EventStatus{
+					Status: http.StatusInternalServerError,
+					Error:  "Internal Server Error",
+				}
+				continue
+			}
+			statuses[i] = api.EventStatus{
+				Status: http.StatusOK,
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Printf("Failed to encode statuses: %v", err)
+	}
+}
+
+// skipStored removes events that were already stored by an earlier attempt
+// from keys, entities and index, marking them successful in statuses.
+//
+// Unlike storeEvent, this is not transactional: concurrent retries of the
+// same batch may both store an event, but under the same key.
+func skipStored(ctx context.Context, keys []*datastore.Key, entities []*eventEntity, index []int, statuses []api.EventStatus) ([]*datastore.Key, []*eventEntity, []int) {
+	var complete []*datastore.Key
+	for _, k := range keys {
+		if !k.Incomplete() {
+			complete = append(complete, k)
+		}
+	}
+	if len(complete) == 0 {
+		return keys, entities, index
+	}
+
+	existing := make([]eventEntity, len(complete))
+	err := datastore.GetMulti(ctx, complete, existing)
+	merr, multi := err.(appengine.MultiError)
+	if err != nil && !multi {
+		// Store them all; at worst, events are overwritten by
+		// identical copies.
+		log.Printf("Failed to check for stored events: %v", err)
+		return keys, entities, index
+	}
+
+	var (
+		rkeys     []*datastore.Key
+		rentities []*eventEntity
+		rindex    []int
+	)
+	c := 0
+	for j, k := range keys {
+		if !k.Incomplete() {
+			var gerr error
+			if multi {
+				gerr = merr[c]
+			}
+			c++
+			if gerr == nil || isFieldMismatch(gerr) {
+				statuses[index[j]] = api.EventStatus{
+					Status: http.StatusOK,
+				}
+				continue
+			}
+		}
+		rkeys = append(rkeys, k)
+		rentities = append(rentities, entities[j])
+		rindex = append(rindex, index[j])
+	}
+	return rkeys, rentities, rindex
+}
+
+// isFieldMismatch returns true if err is a *datastore.ErrFieldMismatch, which
+// is returned when loading an entity stored with different fields.
+func isFieldMismatch(err error) bool {
+	_, ok := err.(*datastore.ErrFieldMismatch)
+	return ok
+}
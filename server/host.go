@@ -0,0 +1,513 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prattmic/restic-remote/api"
+	"github.com/prattmic/restic-remote/auth0"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	jose "gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+// hostTokenKey is the HMAC key used to sign host access tokens. Host
+// enrollment is disabled if it is empty.
+var hostTokenKey = os.Getenv("HOST_TOKEN_KEY")
+
+const (
+	// hostTokenIssuer is the issuer of host access tokens.
+	hostTokenIssuer = "restic-remote"
+
+	// hostTokenLifetime is how long host access tokens are valid.
+	hostTokenLifetime = time.Hour
+
+	// hostSubjectPrefix prefixes the credential ID in the subject of host
+	// access tokens.
+	hostSubjectPrefix = "host:"
+
+	// hostScopes are the scopes granted to host access tokens.
+	hostScopes = "write:events read:release"
+
+	// defaultEnrollmentTTL is how long enrollment tokens are valid by
+	// default.
+	defaultEnrollmentTTL = 24 * time.Hour
+)
+
+// enrollmentEntity is a one-time enrollment token, keyed by the hash of the
+// token.
+type enrollmentEntity struct {
+	// Hostname restricts the token to one hostname, if set.
+	Hostname string
+
+	// Created and Expires are when the token was created and expires.
+	Created time.Time
+	Expires time.Time
+
+	// Used is when the token was exchanged, or zero if it is unused.
+	Used time.Time
+
+	// CredentialID is the ID of the credential issued for the token.
+	CredentialID string
+}
+
+// credentialEntity is a host credential, keyed by the credential ID.
+type credentialEntity struct {
+	// Hostname is the hostname the credential is bound to.
+	Hostname string
+
+	// SecretHash is the hash of the credential secret.
+	SecretHash string `datastore:",noindex"`
+
+	// Created is when the credential was issued.
+	Created time.Time
+
+	// Revoked is when the credential was revoked, or zero if it is valid.
+	Revoked time.Time
+}
+
+// hostClaims are the private claims of host access tokens.
+type hostClaims struct {
+	Host  string `json:"host"`
+	Scope string `json:"scope"`
+}
+
+// tokenRequest is the client credentials request sent by auth0.NewClient.
+type tokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Audience     string `json:"audience"`
+}
+
+// tokenResponse is the response to a tokenRequest.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   uint64 `json:"expires_in"`
+}
+
+// errorResponse is the body of authentication failures.
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashSecret returns the hex encoded hash of a token or secret.
+func hashSecret(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// writeError writes an error response with code and message.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s", message)
+}
+
+// readJSON decodes the JSON body of r into v.
+func readJSON(r *http.Request, v interface{}) error {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("error reading body: %v", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error decoding %q: %v", string(b), err)
+	}
+	return nil
+}
+
+// createEnrollment creates a one-time enrollment token.
+func createEnrollment(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "Only POST requests allowed")
+		return
+	}
+
+	var req api.CreateEnrollmentRequest
+	if err := readJSON(r, &req); err != nil {
+		log.Printf("Malformed enrollment request: %v", err)
+		writeError(w, http.StatusBadRequest, "Malformed request")
+		return
+	}
+
+	ttl := time.Duration(req.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultEnrollmentTTL
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		log.Printf("Failed to generate token: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	now := time.Now()
+	e := enrollmentEntity{
+		Hostname: req.Hostname,
+		Created:  now,
+		Expires:  now.Add(ttl),
+	}
+	key := datastore.NewKey(ctx, "Enrollment", hashSecret(token), 0, nil)
+	if _, err := datastore.Put(ctx, key, &e); err != nil {
+		log.Printf("Failed to store enrollment: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	json.NewEncoder(w).Encode(&api.CreateEnrollmentResponse{
+		Token:   token,
+		Expires: e.Expires.Unix(),
+	})
+}
+
+// errEnrollment is returned when an enrollment token cannot be used.
+type errEnrollment string
+
+func (e errEnrollment) Error() string { return string(e) }
+
+// enroll exchanges an enrollment token for host credentials.
+func enroll(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "Only POST requests allowed")
+		return
+	}
+
+	var req api.EnrollRequest
+	if err := readJSON(r, &req); err != nil {
+		log.Printf("Malformed enroll request: %v", err)
+		writeError(w, http.StatusBadRequest, "Malformed request")
+		return
+	}
+	if req.Token == "" || req.Hostname == "" {
+		writeError(w, http.StatusBadRequest, "token and hostname required")
+		return
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		log.Printf("Failed to generate credential ID: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		log.Printf("Failed to generate credential secret: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	ekey := datastore.NewKey(ctx, "Enrollment", hashSecret(req.Token), 0, nil)
+	ckey := datastore.NewKey(ctx, "Credential", id, 0, nil)
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var e enrollmentEntity
+		if err := datastore.Get(tc, ekey, &e); err == datastore.ErrNoSuchEntity {
+			return errEnrollment("unknown enrollment token")
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		switch {
+		case !e.Used.IsZero():
+			return errEnrollment("enrollment token already used")
+		case now.After(e.Expires):
+			return errEnrollment("enrollment token expired")
+		case e.Hostname != "" && e.Hostname != req.Hostname:
+			return errEnrollment(fmt.Sprintf("enrollment token not valid for hostname %q", req.Hostname))
+		}
+
+		e.Used = now
+		e.CredentialID = id
+		if _, err := datastore.Put(tc, ekey, &e); err != nil {
+			return err
+		}
+
+		c := credentialEntity{
+			Hostname:   req.Hostname,
+			SecretHash: hashSecret(secret),
+			Created:    now,
+		}
+		_, err := datastore.Put(tc, ckey, &c)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if ee, ok := err.(errEnrollment); ok {
+		log.Printf("Rejected enrollment of %q: %v", req.Hostname, ee)
+		writeError(w, http.StatusForbidden, ee.Error())
+		return
+	} else if err != nil {
+		log.Printf("Failed to enroll %q: %v", req.Hostname, err)
+		writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	log.Printf("Enrolled %q with credential %s", req.Hostname, id)
+
+	json.NewEncoder(w).Encode(&api.EnrollResponse{
+		ClientID:     id,
+		ClientSecret: secret,
+		TokenURL:     "https://" + r.Host + api.TokenEndpoint,
+	})
+}
+
+// token issues host access tokens for host credentials.
+func token(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "Only POST requests allowed")
+		return
+	}
+
+	var req tokenRequest
+	if err := readJSON(r, &req); err != nil {
+		log.Printf("Malformed token request: %v", err)
+		writeError(w, http.StatusBadRequest, "Malformed request")
+		return
+	}
+	if req.GrantType != "client_credentials" || req.Audience != api.HostAudience {
+		writeError(w, http.StatusBadRequest, "Unsupported grant type or audience")
+		return
+	}
+
+	var c credentialEntity
+	key := datastore.NewKey(ctx, "Credential", req.ClientID, 0, nil)
+	if err := datastore.Get(ctx, key, &c); err != nil {
+		log.Printf("Failed to get credential %q: %v", req.ClientID, err)
+		writeError(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+	if !c.Revoked.IsZero() || subtle.ConstantTimeCompare([]byte(hashSecret(req.ClientSecret)), []byte(c.SecretHash)) != 1 {
+		log.Printf("Rejected credential %q for %q", req.ClientID, c.Hostname)
+		writeError(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte(hostTokenKey)}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		log.Printf("Failed to create signer: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:   hostTokenIssuer,
+		Subject:  hostSubjectPrefix + req.ClientID,
+		Audience: jwt.Audience{api.HostAudience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(hostTokenLifetime)),
+	}
+	t, err := jwt.Signed(sig).Claims(claims).Claims(hostClaims{Host: c.Hostname, Scope: hostScopes}).CompactSerialize()
+	if err != nil {
+		log.Printf("Failed to sign token: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	json.NewEncoder(w).Encode(&tokenResponse{
+		AccessToken: t,
+		TokenType:   "Bearer",
+		ExpiresIn:   uint64(hostTokenLifetime / time.Second),
+	})
+}
+
+// credentialInfo describes a host credential for listing.
+type credentialInfo struct {
+	ID       string
+	Hostname string
+	Created  time.Time
+	Revoked  time.Time
+}
+
+// credentials lists (GET) or revokes (DELETE ?id=) host credentials.
+func credentials(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	switch r.Method {
+	case "GET":
+		var cs []credentialEntity
+		keys, err := datastore.NewQuery("Credential").Order("Hostname").GetAll(ctx, &cs)
+		if err != nil {
+			log.Printf("Failed to list credentials: %v", err)
+			writeError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		infos := []credentialInfo{}
+		for i, c := range cs {
+			infos = append(infos, credentialInfo{
+				ID:       keys[i].StringID(),
+				Hostname: c.Hostname,
+				Created:  c.Created,
+				Revoked:  c.Revoked,
+			})
+		}
+		json.NewEncoder(w).Encode(infos)
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		key := datastore.NewKey(ctx, "Credential", id, 0, nil)
+		err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			var c credentialEntity
+			if err := datastore.Get(tc, key, &c); err != nil {
+				return err
+			}
+			if c.Revoked.IsZero() {
+				c.Revoked = time.Now()
+			}
+			_, err := datastore.Put(tc, key, &c)
+			return err
+		}, nil)
+		if err == datastore.ErrNoSuchEntity {
+			writeError(w, http.StatusNotFound, "no such credential")
+			return
+		} else if err != nil {
+			log.Printf("Failed to revoke credential %q: %v", id, err)
+			writeError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		log.Printf("Revoked credential %q", id)
+		fmt.Fprintf(w, "Revoked %s", id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s requests not allowed", r.Method))
+	}
+}
+
+// parseHostToken returns the host access token in the Authorization header of
+// r, or nil if there is none.
+func parseHostToken(r *http.Request) *jwt.JSONWebToken {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil
+	}
+
+	t, err := jwt.ParseSigned(strings.TrimPrefix(h, "Bearer "))
+	if err != nil || len(t.Headers) < 1 || t.Headers[0].Algorithm != string(jose.HS256) {
+		return nil
+	}
+	return t
+}
+
+// validateHostToken validates host access token t, returning the identity and
+// scopes it grants.
+func validateHostToken(ctx context.Context, t *jwt.JSONWebToken) (*identity, []string, error) {
+	var c jwt.Claims
+	var hc hostClaims
+	if err := t.Claims([]byte(hostTokenKey), &c, &hc); err != nil {
+		return nil, nil, fmt.Errorf("invalid signature: %v", err)
+	}
+
+	err := c.Validate(jwt.Expected{
+		Issuer:   hostTokenIssuer,
+		Audience: jwt.Audience{api.HostAudience},
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid claims: %v", err)
+	}
+
+	if !strings.HasPrefix(c.Subject, hostSubjectPrefix) {
+		return nil, nil, fmt.Errorf("invalid subject %q", c.Subject)
+	}
+	id := strings.TrimPrefix(c.Subject, hostSubjectPrefix)
+
+	// Check for revocation on every request, so that revocation takes
+	// effect immediately.
+	var cred credentialEntity
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, "Credential", id, 0, nil), &cred); err != nil {
+		return nil, nil, fmt.Errorf("error getting credential %q: %v", id, err)
+	}
+	if !cred.Revoked.IsZero() {
+		return nil, nil, fmt.Errorf("credential %q revoked at %v", id, cred.Revoked)
+	}
+
+	return &identity{
+		Subject:  c.Subject,
+		Hostname: cred.Hostname,
+	}, strings.Split(hc.Scope, " "), nil
+}
+
+// authenticate returns an http.Handler which accepts requests with a valid
+// host access token with the specified scopes, or that are accepted by
+// v.ValidateWithScopes, before calling into h.
+//
+// Requests authenticated with a host access token carry the host identity in
+// their context, for requestIdentity.
+func authenticate(v *auth0.Validator, scopes auth0.MethodScopes, h http.Handler) http.Handler {
+	validated := v.ValidateWithScopes(scopes, h)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := parseHostToken(r)
+		if hostTokenKey == "" || t == nil {
+			validated.ServeHTTP(w, r)
+			return
+		}
+
+		id, got, err := validateHostToken(appengine.NewContext(r), t)
+		if err != nil {
+			log.Printf("Host token is not valid: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(errorResponse{
+				Message: "Missing or invalid token.",
+			})
+			return
+		}
+
+		if scopes != nil {
+			want, ok := scopes[r.Method]
+			if !ok || !hasScopes(got, want) {
+				log.Printf("Host %+v scopes %v not ok want %v", id, got, want)
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(errorResponse{
+					Message: "Invalid scopes.",
+				})
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, id)))
+	})
+}
+
+// hasScopes returns true if got contains all of want.
+func hasScopes(got, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if g == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
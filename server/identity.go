@@ -0,0 +1,116 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prattmic/restic-remote/auth0"
+)
+
+var (
+	// hostClaim is the Auth0 access token claim containing the hostname
+	// of the client, if any. Auth0 requires custom claims to be
+	// namespaced, e.g., "https://example.com/host".
+	hostClaim = os.Getenv("AUTH0_HOST_CLAIM")
+
+	// hostSubjects maps Auth0 token subjects to hostnames. It is
+	// configured as comma-separated subject=hostname pairs, e.g.,
+	// "abc123@clients=laptop,def456@clients=desktop".
+	hostSubjects = parseHostSubjects(os.Getenv("AUTH0_HOST_SUBJECTS"))
+
+	// hostnamePolicy determines how event hostnames are checked against
+	// the authenticated host. It is one of the policy constants below.
+	hostnamePolicy = os.Getenv("HOSTNAME_POLICY")
+)
+
+// Hostname policies.
+const (
+	// policyRequire rejects events for a hostname other than the
+	// authenticated host, and events from tokens not bound to a host. It
+	// is the default if AUTH0_HOST_CLAIM or AUTH0_HOST_SUBJECTS is set.
+	policyRequire = "require"
+
+	// policyEnforce rejects events for a hostname other than the
+	// authenticated host, but trusts the hostname of events from tokens
+	// not bound to a host. It is the default otherwise.
+	policyEnforce = "enforce"
+
+	// policyOverwrite replaces the event hostname with the authenticated
+	// host, trusting the hostname of events from tokens not bound to a
+	// host.
+	policyOverwrite = "overwrite"
+)
+
+func init() {
+	switch hostnamePolicy {
+	case "":
+		// Once host binding is configured, unbound tokens are
+		// unexpected, and could write events for any host.
+		hostnamePolicy = policyEnforce
+		if hostClaim != "" || len(hostSubjects) > 0 {
+			hostnamePolicy = policyRequire
+		}
+	case policyRequire, policyEnforce, policyOverwrite:
+	default:
+		panic("HOSTNAME_POLICY must be require, enforce or overwrite")
+	}
+}
+
+// parseHostSubjects parses subject=hostname pairs.
+func parseHostSubjects(s string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.LastIndex(kv, "=")
+		if i < 1 {
+			if kv != "" {
+				log.Printf("Ignoring malformed AUTH0_HOST_SUBJECTS entry %q", kv)
+			}
+			continue
+		}
+		m[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	return m
+}
+
+// identity is the authenticated identity of a request.
+type identity struct {
+	// Subject is the subject of the access token.
+	Subject string
+
+	// Hostname is the host the token belongs to, or "" if the token is
+	// not bound to a host (e.g., shared client credentials).
+	Hostname string
+}
+
+// contextKey is the type of request context keys.
+type contextKey int
+
+// identityKey is the request context key of the *identity of requests
+// authenticated with host access tokens.
+const identityKey contextKey = 0
+
+// requestIdentity returns the identity of r, from a host access token or the
+// claims of an Auth0 access token.
+func requestIdentity(r *http.Request) (*identity, bool) {
+	if id, ok := r.Context().Value(identityKey).(*identity); ok {
+		return id, true
+	}
+
+	claims, ok := auth0.RequestClaims(r)
+	if !ok {
+		return nil, false
+	}
+
+	id := &identity{
+		Subject: claims.Subject(),
+	}
+	if hostClaim != "" {
+		id.Hostname = claims.String(hostClaim)
+	}
+	if id.Hostname == "" {
+		id.Hostname = hostSubjects[id.Subject]
+	}
+	return id, true
+}
@@ -5,27 +5,61 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/prattmic/restic-remote/api"
 	"github.com/prattmic/restic-remote/auth0"
 )
 
-var (
-	auth0JWKS     = os.Getenv("AUTH0_API_JWKS")
-	auth0Issuer   = os.Getenv("AUTH0_API_ISSUER")
-	auth0Audience = os.Getenv("AUTH0_API_AUDIENCE")
-)
+// authProvider is the authentication provider for API requests, one of the
+// auth0.Provider constants. Defaults to auth0.ProviderAuth0.
+var authProvider = os.Getenv("AUTH_PROVIDER")
 
-func init() {
-	if auth0JWKS == "" {
-		panic("AUTH0_API_JWKS must be set")
+// defaultScope is the scope granted to static tokens and client certificates
+// if not configured: everything a client needs.
+const defaultScope = "read:release write:events"
+
+// mustGetenv returns the environment variable name, panicking if it is unset.
+func mustGetenv(name string) string {
+	v := os.Getenv(name)
+	if v == "" {
+		panic(name + " must be set")
 	}
-	if auth0Issuer == "" {
-		panic("AUTH0_API_ISSUER must be set")
+	return v
+}
+
+// getenvDefault returns the environment variable name, or d if it is unset.
+func getenvDefault(name, d string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
 	}
-	if auth0Audience == "" {
-		panic("AUTH0_API_AUDIENCE must be set")
+	return d
+}
+
+// newAuthenticator returns the auth0.Authenticator for authProvider.
+func newAuthenticator() auth0.Authenticator {
+	switch authProvider {
+	case "", auth0.ProviderAuth0:
+		return auth0.NewJWKSAuthenticator(mustGetenv("AUTH0_API_JWKS"), mustGetenv("AUTH0_API_ISSUER"), []string{mustGetenv("AUTH0_API_AUDIENCE")})
+	case auth0.ProviderOIDC:
+		return auth0.NewJWKSAuthenticator(mustGetenv("OIDC_JWKS"), mustGetenv("OIDC_ISSUER"), []string{mustGetenv("OIDC_AUDIENCE")})
+	case auth0.ProviderStatic:
+		tokens, err := auth0.ParseStaticTokens(mustGetenv("STATIC_TOKENS"), getenvDefault("STATIC_TOKEN_SCOPE", defaultScope))
+		if err != nil {
+			panic(fmt.Sprintf("invalid STATIC_TOKENS: %v", err))
+		}
+		return auth0.NewStaticAuthenticator(tokens)
+	case auth0.ProviderMTLS:
+		scopes, err := auth0.ParseSubjectScopes(os.Getenv("MTLS_SCOPES"))
+		if err != nil {
+			panic(fmt.Sprintf("invalid MTLS_SCOPES: %v", err))
+		}
+		return auth0.NewMTLSAuthenticator(scopes, getenvDefault("MTLS_SCOPE", defaultScope))
+	default:
+		panic(fmt.Sprintf("unknown AUTH_PROVIDER %q", authProvider))
 	}
+}
 
-	v := auth0.NewValidator(auth0JWKS, auth0Issuer, []string{auth0Audience})
+func init() {
+	v := auth0.NewValidator(newAuthenticator())
 
 	http.Handle("/", v.ValidateWithScopes(nil, http.HandlerFunc(root)))
 
@@ -33,12 +67,32 @@ func init() {
 		"GET":  []string{"read:release"},
 		"POST": []string{"write:release"},
 	}
-	http.Handle("/api/v1/release", v.ValidateWithScopes(releaseScopes, http.HandlerFunc(release)))
+	http.Handle("/api/v1/release", authenticate(v, releaseScopes, http.HandlerFunc(release)))
 
 	eventScopes := auth0.MethodScopes{
 		"POST": []string{"write:events"},
 	}
-	http.Handle("/api/v1/event", v.ValidateWithScopes(eventScopes, http.HandlerFunc(writeEvent)))
+	http.Handle("/api/v1/event", authenticate(v, eventScopes, http.HandlerFunc(writeEvent)))
+	http.Handle(api.EventsEndpoint, authenticate(v, eventScopes, http.HandlerFunc(writeEvents)))
+
+	// Host enrollment is optional.
+	if hostTokenKey != "" {
+		enrollmentScopes := auth0.MethodScopes{
+			"POST": []string{"write:enrollments"},
+		}
+		http.Handle(api.EnrollmentsEndpoint, v.ValidateWithScopes(enrollmentScopes, http.HandlerFunc(createEnrollment)))
+
+		credentialScopes := auth0.MethodScopes{
+			"GET":    []string{"read:credentials"},
+			"DELETE": []string{"write:credentials"},
+		}
+		http.Handle(api.CredentialsEndpoint, v.ValidateWithScopes(credentialScopes, http.HandlerFunc(credentials)))
+
+		// Authenticated by the enrollment token and host credentials
+		// in the request.
+		http.HandleFunc(api.EnrollEndpoint, enroll)
+		http.HandleFunc(api.TokenEndpoint, token)
+	}
 }
 
 func root(w http.ResponseWriter, r *http.Request) {